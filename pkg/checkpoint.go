@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// s3Checkpoint records how far the lines of an S3 object were sent to Loki, so
+// that a retry of the event can resume from there.
+type s3Checkpoint struct {
+	// ETag of the object the checkpoint was taken on
+	ETag string `json:"etag"`
+	// number of lines read, including the header lines
+	Lines int `json:"lines"`
+	// offset of the next line, only set for uncompressed objects, which are
+	// resumed with a ranged read
+	Offset int64 `json:"offset,omitempty"`
+	// header line naming the fields, for parsers reading them from it
+	Header string `json:"header,omitempty"`
+	// whether every line of the object was sent
+	Complete bool `json:"complete,omitempty"`
+}
+
+// checkpointStore persists the checkpoints of S3 objects.
+type checkpointStore interface {
+	// Get returns nil if the object has no checkpoint.
+	Get(ctx context.Context, bucket, key string) (*s3Checkpoint, error)
+	Put(ctx context.Context, bucket, key string, c *s3Checkpoint) error
+	Delete(ctx context.Context, bucket, key string) error
+}
+
+type s3API interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+var _ checkpointStore = &s3CheckpointStore{}
+
+// s3CheckpointStore keeps each checkpoint as a JSON object under a prefix of a
+// bucket.
+type s3CheckpointStore struct {
+	client s3API
+	bucket string
+	prefix string
+}
+
+// newS3CheckpointStore returns a store for the S3_CHECKPOINT_LOCATION
+// environment variable, in the form s3://bucket[/prefix].
+func newS3CheckpointStore(ctx context.Context, location string) (*s3CheckpointStore, error) {
+	parsed, err := url.Parse(location)
+	if err != nil || parsed.Scheme != "s3" || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid value for environment variable S3_CHECKPOINT_LOCATION: %q, expected s3://bucket[/prefix]", location)
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error loading aws config: %w", err)
+	}
+
+	return &s3CheckpointStore{
+		client: s3.NewFromConfig(cfg),
+		bucket: parsed.Host,
+		prefix: strings.Trim(parsed.Path, "/"),
+	}, nil
+}
+
+func (s *s3CheckpointStore) objectKey(bucket, key string) string {
+	return path.Join(s.prefix, bucket, key) + ".checkpoint.json"
+}
+
+func (s *s3CheckpointStore) Get(ctx context.Context, bucket, key string) (*s3Checkpoint, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(bucket, key)),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error fetching checkpoint of %s/%s: %w", bucket, key, err)
+	}
+	defer out.Body.Close()
+
+	var c s3Checkpoint
+	if err := json.NewDecoder(out.Body).Decode(&c); err != nil {
+		return nil, fmt.Errorf("error decoding checkpoint of %s/%s: %w", bucket, key, err)
+	}
+	return &c, nil
+}
+
+func (s *s3CheckpointStore) Put(ctx context.Context, bucket, key string, c *s3Checkpoint) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.objectKey(bucket, key)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("error saving checkpoint of %s/%s: %w", bucket, key, err)
+	}
+	return nil
+}
+
+func (s *s3CheckpointStore) Delete(ctx context.Context, bucket, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(bucket, key)),
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting checkpoint of %s/%s: %w", bucket, key, err)
+	}
+	return nil
+}
+
+// s3Progress tracks the lines of the S3 objects of an event that were added to
+// a batch, and checkpoints them every time the batch is flushed. A nil
+// s3Progress tracks nothing.
+type s3Progress struct {
+	store   checkpointStore
+	objects []*s3ObjectProgress
+}
+
+type s3ObjectProgress struct {
+	bucket, key string
+	// position after the last line added to the batch
+	checkpoint s3Checkpoint
+	// whether checkpoint changed since it was last saved
+	dirty bool
+	// whether the body being read starts at checkpoint.Offset
+	ranged bool
+	// whether byte offsets can be used to resume the object
+	trackOffset bool
+}
+
+// object loads the checkpoint of an object of the event.
+func (p *s3Progress) object(ctx context.Context, bucket, key string) (*s3ObjectProgress, error) {
+	if p == nil {
+		return nil, nil
+	}
+
+	c, err := p.store.Get(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	o := &s3ObjectProgress{bucket: bucket, key: key}
+	if c != nil {
+		o.checkpoint = *c
+	}
+	p.objects = append(p.objects, o)
+	return o, nil
+}
+
+// snapshot returns a function storing the checkpoints that changed, as they
+// are now. It is called on each flush, and the function it returns once every
+// line added so far has been sent.
+func (p *s3Progress) snapshot() func(ctx context.Context) error {
+	var changed []s3ObjectProgress
+	for _, o := range p.objects {
+		if !o.dirty {
+			continue
+		}
+		changed = append(changed, s3ObjectProgress{bucket: o.bucket, key: o.key, checkpoint: o.checkpoint})
+		o.dirty = false
+	}
+	return func(ctx context.Context) error {
+		for _, o := range changed {
+			if err := p.store.Put(ctx, o.bucket, o.key, &o.checkpoint); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// clear deletes the checkpoints once the whole event was sent. Failing to do
+// so is only logged, a leftover checkpoint marks its object as complete.
+func (p *s3Progress) clear(ctx context.Context, log *log.Logger) {
+	if p == nil {
+		return
+	}
+	for _, o := range p.objects {
+		if err := p.store.Delete(ctx, o.bucket, o.key); err != nil {
+			level.Warn(*log).Log("msg", "failed to delete checkpoint", "err", err) // nolint:errcheck
+		}
+	}
+}
+
+// resume returns the position to resume reading the object from.
+func (o *s3ObjectProgress) resume() s3Checkpoint {
+	if o == nil {
+		return s3Checkpoint{}
+	}
+	return o.checkpoint
+}
+
+// reset discards the checkpoint, when the object changed since it was taken.
+func (o *s3ObjectProgress) reset(etag string) {
+	o.checkpoint = s3Checkpoint{ETag: etag}
+	o.ranged = false
+}
+
+func (o *s3ObjectProgress) setHeader(header string) {
+	if o != nil {
+		o.checkpoint.Header = header
+	}
+}
+
+// advance records a line about to be added to the batch.
+func (o *s3ObjectProgress) advance(lines int, offset int64) {
+	if o == nil {
+		return
+	}
+	o.checkpoint.Lines = lines
+	if o.trackOffset {
+		o.checkpoint.Offset = offset
+	}
+	o.dirty = true
+}
+
+func (o *s3ObjectProgress) complete() {
+	if o == nil {
+		return
+	}
+	o.checkpoint.Complete = true
+	o.dirty = true
+}
+
+// getS3Object fetches an object, starting at the offset of its checkpoint if
+// it has one.
+func getS3Object(ctx context.Context, client s3API, bucket, key string, progress *s3ObjectProgress) (*s3.GetObjectOutput, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+
+	if progress != nil && progress.checkpoint.Offset > 0 {
+		ranged := *input
+		ranged.Range = aws.String(fmt.Sprintf("bytes=%d-", progress.checkpoint.Offset))
+		ranged.IfMatch = aws.String(progress.checkpoint.ETag)
+		obj, err := client.GetObject(ctx, &ranged)
+		if err == nil {
+			progress.ranged = true
+			return obj, nil
+		}
+
+		var apiErr smithy.APIError
+		if !errors.As(err, &apiErr) {
+			return nil, err
+		}
+		switch apiErr.ErrorCode() {
+		case "InvalidRange":
+			// Every line was added before the last checkpoint.
+			progress.ranged = true
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(""))}, nil
+		case "PreconditionFailed":
+			// The object changed, read it again from the start.
+			progress.reset("")
+		default:
+			return nil, err
+		}
+	}
+
+	obj, err := client.GetObject(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if progress != nil && progress.checkpoint.ETag != aws.ToString(obj.ETag) {
+		progress.reset(aws.ToString(obj.ETag))
+	}
+	return obj, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/go-kit/log"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/stretchr/testify/require"
+)
+
+type memCheckpointStore map[string]s3Checkpoint
+
+func (m memCheckpointStore) Get(_ context.Context, bucket, key string) (*s3Checkpoint, error) {
+	c, ok := m[bucket+"/"+key]
+	if !ok {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+func (m memCheckpointStore) Put(_ context.Context, bucket, key string, c *s3Checkpoint) error {
+	m[bucket+"/"+key] = *c
+	return nil
+}
+
+func (m memCheckpointStore) Delete(_ context.Context, bucket, key string) error {
+	delete(m, bucket+"/"+key)
+	return nil
+}
+
+// linesClient records the lines it sends, and fails once it sent failAfter batches.
+type linesClient struct {
+	lines     []string
+	batches   int
+	failAfter int
+}
+
+func (c *linesClient) sendToPromtail(_ context.Context, b *batch) error {
+	if c.failAfter > 0 && c.batches == c.failAfter {
+		return errors.New("loki unavailable")
+	}
+	c.batches++
+	for _, stream := range b.streams {
+		for _, e := range stream.Entries {
+			c.lines = append(c.lines, e.Line)
+		}
+	}
+	return nil
+}
+
+// fakeS3 serves a single object, honoring the Range and IfMatch of requests.
+type fakeS3 struct {
+	s3API
+	data   []byte
+	etag   string
+	inputs []*s3.GetObjectInput
+}
+
+func (f *fakeS3) GetObject(_ context.Context, params *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.inputs = append(f.inputs, params)
+	data := f.data
+	if params.IfMatch != nil && *params.IfMatch != f.etag {
+		return nil, &smithy.GenericAPIError{Code: "PreconditionFailed"}
+	}
+	if params.Range != nil {
+		var offset int
+		if _, err := fmt.Sscanf(*params.Range, "bytes=%d-", &offset); err != nil {
+			return nil, err
+		}
+		if offset >= len(data) {
+			return nil, &smithy.GenericAPIError{Code: "InvalidRange"}
+		}
+		data = data[offset:]
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data)), ETag: aws.String(f.etag)}, nil
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+// attemptS3Object processes the object once, the way processS3Event does.
+func attemptS3Object(t *testing.T, store checkpointStore, client *linesClient, fake *fakeS3) error {
+	t.Helper()
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	b, err := newBatch(context.Background(), client, process)
+	require.NoError(t, err)
+	progress := &s3Progress{store: store}
+	b.saveProgress = progress.snapshot
+
+	o, err := progress.object(context.Background(), "bucket", "object.log")
+	require.NoError(t, err)
+	if o.checkpoint.Complete {
+		return nil
+	}
+	obj, err := getS3Object(context.Background(), fake, "bucket", "object.log", o)
+	require.NoError(t, err)
+	defer obj.Body.Close()
+
+	logger := log.NewNopLogger()
+	labels := map[string]string{"type": S3AccessLogType, "src": "bucket", "account_id": "123456789012", "key": "object.log"}
+	if err := parseS3LogFrom(context.Background(), b, labels, obj.Body, &logger, o); err != nil {
+		return err
+	}
+	b.saveProgress = nil
+	if err := b.flushBatch(context.Background()); err != nil {
+		return err
+	}
+	progress.clear(context.Background(), &logger)
+	return nil
+}
+
+func Test_s3Checkpoints(t *testing.T) {
+	lines := []string{"line 1", "line 2", "line 3", "line 4", "line 5"}
+	content := []byte(strings.Join(lines, "\n") + "\n")
+
+	for name, tc := range map[string]struct {
+		data        []byte
+		wantOffset  int64
+		wantRangeAt string
+	}{
+		"uncompressed objects resume with a ranged read": {
+			data:        content,
+			wantOffset:  int64(len("line 1\nline 2\n")),
+			wantRangeAt: fmt.Sprintf("bytes=%d-", len("line 1\nline 2\n")),
+		},
+		"compressed objects skip the lines sent": {
+			data: gzipData(t, content),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			batchSize = 1 // flush every line
+			defer func() { batchSize = 131072 }()
+
+			store := memCheckpointStore{}
+			fake := &fakeS3{data: tc.data, etag: `"etag"`}
+
+			failing := &linesClient{failAfter: 2}
+			require.Error(t, attemptS3Object(t, store, failing, fake))
+			require.Equal(t, lines[:2], failing.lines)
+			require.Equal(t, s3Checkpoint{ETag: `"etag"`, Lines: 2, Offset: tc.wantOffset}, store["bucket/object.log"])
+
+			retry := &linesClient{}
+			require.NoError(t, attemptS3Object(t, store, retry, fake))
+			require.Equal(t, lines[2:], retry.lines)
+			require.Empty(t, store)
+
+			last := fake.inputs[len(fake.inputs)-1]
+			if tc.wantRangeAt == "" {
+				require.Nil(t, last.Range)
+			} else {
+				require.Equal(t, tc.wantRangeAt, aws.ToString(last.Range))
+				require.Equal(t, `"etag"`, aws.ToString(last.IfMatch))
+			}
+		})
+	}
+}
+
+func Test_s3Checkpoints_completeObject(t *testing.T) {
+	store := memCheckpointStore{"bucket/object.log": {ETag: `"etag"`, Lines: 5, Complete: true}}
+	fake := &fakeS3{data: []byte("line 1\n"), etag: `"etag"`}
+
+	client := &linesClient{}
+	require.NoError(t, attemptS3Object(t, store, client, fake))
+	require.Empty(t, client.lines)
+	require.Empty(t, fake.inputs)
+}
+
+func Test_getS3Object(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("changed objects are read from the start", func(t *testing.T) {
+		fake := &fakeS3{data: []byte("line 1\nline 2\n"), etag: `"new"`}
+		o := &s3ObjectProgress{checkpoint: s3Checkpoint{ETag: `"old"`, Lines: 1, Offset: 7}}
+
+		obj, err := getS3Object(ctx, fake, "bucket", "key", o)
+		require.NoError(t, err)
+		data, err := io.ReadAll(obj.Body)
+		require.NoError(t, err)
+		require.Equal(t, "line 1\nline 2\n", string(data))
+		require.False(t, o.ranged)
+		require.Equal(t, s3Checkpoint{ETag: `"new"`}, o.checkpoint)
+	})
+
+	t.Run("nothing is left past the end of the object", func(t *testing.T) {
+		fake := &fakeS3{data: []byte("line 1\n"), etag: `"etag"`}
+		o := &s3ObjectProgress{checkpoint: s3Checkpoint{ETag: `"etag"`, Lines: 1, Offset: 7}}
+
+		obj, err := getS3Object(ctx, fake, "bucket", "key", o)
+		require.NoError(t, err)
+		data, err := io.ReadAll(obj.Body)
+		require.NoError(t, err)
+		require.Empty(t, data)
+		require.True(t, o.ranged)
+	})
+}
+
+func Test_parseS3LogFrom_rangedHeader(t *testing.T) {
+	batchSize = 131072
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	b := &batch{
+		streams:   map[string]*logproto.Stream{},
+		processor: process,
+	}
+	o := &s3ObjectProgress{
+		checkpoint: s3Checkpoint{Lines: 2, Offset: 100, Header: "srcaddr start action"},
+		ranged:     true,
+	}
+	logger := log.NewNopLogger()
+	labels := map[string]string{"type": FlowLogType, "src": "source", "account_id": "123456789"}
+	obj := io.NopCloser(strings.NewReader("10.0.0.3 1669842701 REJECT\n"))
+
+	require.NoError(t, parseS3LogFrom(context.Background(), b, labels, obj, &logger, o))
+	stream := b.streams[`{__aws_log_type="s3_vpc_flow", __aws_s3_vpc_flow="source", __aws_s3_vpc_flow_owner="123456789"}`]
+	require.NotNil(t, stream)
+	require.Len(t, stream.Entries, 1)
+	require.Equal(t, "10.0.0.3 1669842701 REJECT", stream.Entries[0].Line)
+	require.Equal(t, int64(1669842701), stream.Entries[0].Timestamp.Unix())
+	require.Equal(t, s3Checkpoint{Lines: 3, Offset: 127, Header: "srcaddr start action", Complete: true}, o.checkpoint)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// decompressor is a compression format S3 objects and Kinesis records can be
+// compressed with. It is detected by the magic bytes at the start of the data,
+// falling back to the extension of the S3 object key when the data is too
+// short to hold them.
+// source: https://en.wikipedia.org/wiki/List_of_file_signatures
+type decompressor struct {
+	name  string
+	magic []byte
+	// checks the byte following magic, if set
+	next       func(b byte) bool
+	extensions []string
+	newReader  func(r io.Reader) (io.ReadCloser, error)
+}
+
+// headerLen is the number of bytes needed to detect d.
+func (d *decompressor) headerLen() int {
+	if d.next != nil {
+		return len(d.magic) + 1
+	}
+	return len(d.magic)
+}
+
+// matches returns whether data starts with the header of d.
+func (d *decompressor) matches(data []byte) bool {
+	if !bytes.HasPrefix(data, d.magic) {
+		return false
+	}
+	return d.next == nil || (len(data) > len(d.magic) && d.next(data[len(d.magic)]))
+}
+
+var decompressors = []decompressor{
+	{
+		name:       "gzip",
+		magic:      []byte{0x1f, 0x8b},
+		extensions: []string{".gz"},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	{
+		name:       "zstd",
+		magic:      []byte{0x28, 0xb5, 0x2f, 0xfd},
+		extensions: []string{".zst", ".zstd"},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			// Lambda functions usually have a single vCPU, decoding concurrently only adds overhead.
+			decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+	},
+	{
+		// "BZh" is followed by the block size, from '1' to '9'.
+		name:       "bzip2",
+		magic:      []byte("BZh"),
+		next:       func(b byte) bool { return b >= '1' && b <= '9' },
+		extensions: []string{".bz2"},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(bzip2.NewReader(r)), nil
+		},
+	},
+	{
+		// The stream identifier chunk every snappy framed stream starts with.
+		// source: https://github.com/google/snappy/blob/main/framing_format.txt
+		name:       "snappy",
+		magic:      []byte("\xff\x06\x00\x00sNaPpY"),
+		extensions: []string{".sz"},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(snappy.NewReader(r)), nil
+		},
+	},
+}
+
+// maxMagicLen is the number of bytes needed to detect every decompressor.
+var maxMagicLen = func() int {
+	n := 0
+	for i := range decompressors {
+		n = max(n, decompressors[i].headerLen())
+	}
+	return n
+}()
+
+// detectDecompressor returns the decompressor whose magic bytes data starts
+// with. The extension of key is only trusted when data is too short to hold the
+// magic bytes of the decompressor it matches, a header that doesn't match
+// means the object isn't compressed whatever its key. It returns nil for
+// uncompressed data.
+func detectDecompressor(data []byte, key string) *decompressor {
+	for i := range decompressors {
+		if decompressors[i].matches(data) {
+			return &decompressors[i]
+		}
+	}
+	if key == "" {
+		return nil
+	}
+	for i := range decompressors {
+		if len(data) >= decompressors[i].headerLen() {
+			continue
+		}
+		for _, ext := range decompressors[i].extensions {
+			if strings.HasSuffix(key, ext) {
+				return &decompressors[i]
+			}
+		}
+	}
+	return nil
+}
+
+// decompressReader returns a reader of the decompressed content of reader, or
+// of the content as is if it isn't compressed, and whether it was compressed.
+// key is the S3 object key used as a fallback for detection, it may be empty.
+func decompressReader(reader io.ReadCloser, key string) (io.ReadCloser, bool, error) {
+	magic, reader, err := peekReader(reader, maxMagicLen)
+	if err != nil {
+		return reader, false, err
+	}
+
+	d := detectDecompressor(magic, key)
+	if d == nil {
+		return reader, false, nil
+	}
+	decompressed, err := d.newReader(reader)
+	return decompressed, true, err
+}
+
+// decompressData returns the decompressed data, or data as is if it isn't compressed.
+func decompressData(data []byte) ([]byte, error) {
+	d := detectDecompressor(data, "")
+	if d == nil {
+		return data, nil
+	}
+
+	reader, err := d.newReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_decompressData(t *testing.T) {
+	plain := []byte(`{"logGroup":"test"}`)
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	_, err := gw.Write(plain)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	encoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	zstdData := encoder.EncodeAll(plain, nil)
+
+	var framed bytes.Buffer
+	sw := snappy.NewBufferedWriter(&framed)
+	_, err = sw.Write(plain)
+	require.NoError(t, err)
+	require.NoError(t, sw.Close())
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "uncompressed", data: plain},
+		{name: "gzip", data: gzipped.Bytes()},
+		{name: "zstd", data: zstdData},
+		{name: "snappy", data: framed.Bytes()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := decompressData(tt.data)
+			require.NoError(t, err)
+			require.Equal(t, plain, data)
+		})
+	}
+
+	_, err = decompressData([]byte{0x1f, 0x8b, 0x00})
+	require.Error(t, err)
+}
+
+func Test_detectDecompressor(t *testing.T) {
+	require.Nil(t, detectDecompressor([]byte("plain text"), "object.log"))
+	require.Nil(t, detectDecompressor(nil, ""))
+	require.Equal(t, "bzip2", detectDecompressor([]byte("BZh91AY"), "object").name)
+	require.Nil(t, detectDecompressor([]byte("BZhello"), "object.log"), "bzip2 requires a block size")
+	require.Nil(t, detectDecompressor([]byte("BZh0"), "object.log"), "bzip2 requires a block size")
+	// The extension is only used when the data is too short to tell.
+	require.Nil(t, detectDecompressor([]byte("plain text"), "object.log.zst"))
+	require.Nil(t, detectDecompressor([]byte("BZhello"), "object.log.bz2"))
+	require.Equal(t, "zstd", detectDecompressor([]byte("ab"), "object.log.zst").name)
+	require.Equal(t, "gzip", detectDecompressor(nil, "object.log.gz").name)
+}
+
+func Test_decompressReader_shortInput(t *testing.T) {
+	reader, compressed, err := decompressReader(io.NopCloser(bytes.NewReader([]byte("a"))), "")
+	require.NoError(t, err)
+	require.False(t, compressed)
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), data)
+}
@@ -27,14 +27,19 @@ func parseCWEvent(ctx context.Context, b *batch, ev *events.CloudwatchLogsEvent)
 		labels[model.LabelName("__aws_cloudwatch_log_stream")] = model.LabelValue(data.LogStream)
 	}
 
+	metadata := structuredMetadata(labels, model.LabelSet{
+		model.LabelName("__aws_cloudwatch_log_stream"): model.LabelValue(data.LogStream),
+	})
+
 	labels = applyLabels(labels)
 
 	for _, event := range data.LogEvents {
 		timestamp := time.UnixMilli(event.Timestamp)
 
 		if err := b.add(ctx, entry{labels, logproto.Entry{
-			Line:      event.Message,
-			Timestamp: timestamp,
+			Line:               event.Message,
+			Timestamp:          timestamp,
+			StructuredMetadata: metadata,
 		}}); err != nil {
 			return err
 		}
@@ -54,7 +59,7 @@ func processCWEvent(ctx context.Context, ev *events.CloudwatchLogsEvent, pClient
 		return fmt.Errorf("error parsing log event: %s", err)
 	}
 
-	err = pClient.sendToPromtail(ctx, batch)
+	err = batch.flushBatch(ctx)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// deadLetter is a batch that couldn't be sent to a destination.
+type deadLetter struct {
+	Destination string    `json:"destination"`
+	TenantID    string    `json:"tenant_id,omitempty"`
+	Error       string    `json:"error"`
+	Status      int       `json:"status,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+	// labels of the streams of the batch
+	Streams []string `json:"streams"`
+	Entries int      `json:"entries"`
+	// the PushRequest as sent to Loki, in the wire format of PUSH_FORMAT
+	Request []byte `json:"request"`
+	// PUSH_FORMAT the request is encoded with, protobuf if empty
+	Format string `json:"format,omitempty"`
+}
+
+func newDeadLetter(d *destination, tenantID string, b *batch, enc *pushEncoder, buf []byte, status int, err error) *deadLetter {
+	letter := &deadLetter{
+		Destination: d.name,
+		TenantID:    tenantID,
+		Error:       err.Error(),
+		Status:      status,
+		Timestamp:   time.Now().UTC(),
+		Streams:     make([]string, 0, len(b.streams)),
+		Entries:     b.entriesCount(),
+		Request:     buf,
+		Format:      enc.format,
+	}
+	if status < 0 {
+		letter.Status = 0
+	}
+	for _, stream := range b.streams {
+		letter.Streams = append(letter.Streams, stream.Labels)
+	}
+	sort.Strings(letter.Streams)
+	return letter
+}
+
+// deadLetterSink stores the batches that fail to be sent.
+type deadLetterSink interface {
+	Put(ctx context.Context, letter *deadLetter) error
+	// Replay calls replay with the dead letters of the sink, and removes the
+	// ones it succeeds with. It stops before the deadline of ctx.
+	Replay(ctx context.Context, replay func(ctx context.Context, letter *deadLetter) error) (int, error)
+}
+
+var sqsQueueURLRegex = regexp.MustCompile(`^https://sqs\.([\w-]+)\.amazonaws\.com(?:\.cn)?/\d+/[\w-]+(?:\.fifo)?$`)
+
+// newDeadLetterSink returns the sink of the DEAD_LETTER_LOCATION environment
+// variable, either s3://bucket[/prefix] or the URL of an SQS queue.
+func newDeadLetterSink(ctx context.Context, location string) (deadLetterSink, error) {
+	if match := sqsQueueURLRegex.FindStringSubmatch(location); match != nil {
+		cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(match[1]))
+		if err != nil {
+			return nil, fmt.Errorf("error loading aws config: %w", err)
+		}
+		return &sqsDeadLetterSink{client: sqs.NewFromConfig(cfg), queueURL: location}, nil
+	}
+
+	parsed, err := url.Parse(location)
+	if err != nil || parsed.Scheme != "s3" || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid value for environment variable DEAD_LETTER_LOCATION: %q, expected s3://bucket[/prefix] or an SQS queue URL", location)
+	}
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error loading aws config: %w", err)
+	}
+	return &s3DeadLetterSink{
+		client: s3.NewFromConfig(cfg),
+		bucket: parsed.Host,
+		prefix: strings.Trim(parsed.Path, "/"),
+	}, nil
+}
+
+type s3DeadLetterAPI interface {
+	s3API
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+}
+
+var _ deadLetterSink = &s3DeadLetterSink{}
+
+// s3DeadLetterSink keeps each dead letter as a JSON object under a prefix of a
+// bucket.
+type s3DeadLetterSink struct {
+	client s3DeadLetterAPI
+	bucket string
+	prefix string
+}
+
+func (s *s3DeadLetterSink) Put(ctx context.Context, letter *deadLetter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	key := path.Join(s.prefix, fmt.Sprintf("%s-%s-%s.json", letter.Timestamp.Format("20060102T150405.000000000Z"), letter.Destination, hex.EncodeToString(suffix)))
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("error writing dead letter to s3://%s/%s: %w", s.bucket, key, err)
+	}
+	return nil
+}
+
+func (s *s3DeadLetterSink) Replay(ctx context.Context, replay func(ctx context.Context, letter *deadLetter) error) (int, error) {
+	prefix := s.prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var replayed int
+	var errs []error
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return replayed, errors.Join(append(errs, err)...)
+		}
+		for _, obj := range page.Contents {
+			if approachingDeadline(ctx, deadlineFlushMargin) {
+				return replayed, errors.Join(append(errs, &deadlineError{sent: replayed})...)
+			}
+			if err := s.replayObject(ctx, aws.ToString(obj.Key), replay); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			replayed++
+		}
+	}
+	return replayed, errors.Join(errs...)
+}
+
+func (s *s3DeadLetterSink) replayObject(ctx context.Context, key string, replay func(ctx context.Context, letter *deadLetter) error) error {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("error reading dead letter s3://%s/%s: %w", s.bucket, key, err)
+	}
+	var letter deadLetter
+	err = json.NewDecoder(out.Body).Decode(&letter)
+	out.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error decoding dead letter s3://%s/%s: %w", s.bucket, key, err)
+	}
+
+	if err := replay(ctx, &letter); err != nil {
+		return fmt.Errorf("error replaying dead letter s3://%s/%s: %w", s.bucket, key, err)
+	}
+
+	_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting dead letter s3://%s/%s: %w", s.bucket, key, err)
+	}
+	return nil
+}
+
+type sqsAPI interface {
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+}
+
+var _ deadLetterSink = &sqsDeadLetterSink{}
+
+// sqsDeadLetterSink sends each dead letter as a JSON message to a queue. SQS
+// limits the size of messages, so keep BATCH_SIZE well below it.
+type sqsDeadLetterSink struct {
+	client   sqsAPI
+	queueURL string
+}
+
+func (s *sqsDeadLetterSink) Put(ctx context.Context, letter *deadLetter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(s.queueURL),
+		MessageBody: aws.String(string(data)),
+	})
+	if err != nil {
+		return fmt.Errorf("error sending dead letter to %s: %w", s.queueURL, err)
+	}
+	return nil
+}
+
+// Replay receives messages until the queue is empty. Messages that fail to be
+// replayed stay invisible for the visibility timeout of the queue, so they
+// aren't received twice by the same replay.
+func (s *sqsDeadLetterSink) Replay(ctx context.Context, replay func(ctx context.Context, letter *deadLetter) error) (int, error) {
+	var replayed int
+	var errs []error
+	for {
+		if approachingDeadline(ctx, deadlineFlushMargin) {
+			return replayed, errors.Join(append(errs, &deadlineError{sent: replayed})...)
+		}
+		out, err := s.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(s.queueURL),
+			MaxNumberOfMessages: 10,
+		})
+		if err != nil {
+			return replayed, errors.Join(append(errs, err)...)
+		}
+		if len(out.Messages) == 0 {
+			return replayed, errors.Join(errs...)
+		}
+
+		for _, msg := range out.Messages {
+			var letter deadLetter
+			if err := json.Unmarshal([]byte(aws.ToString(msg.Body)), &letter); err != nil {
+				errs = append(errs, fmt.Errorf("error decoding dead letter %s: %w", aws.ToString(msg.MessageId), err))
+				continue
+			}
+			if err := replay(ctx, &letter); err != nil {
+				errs = append(errs, fmt.Errorf("error replaying dead letter %s: %w", aws.ToString(msg.MessageId), err))
+				continue
+			}
+			_, err := s.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(s.queueURL),
+				ReceiptHandle: msg.ReceiptHandle,
+			})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("error deleting dead letter %s: %w", aws.ToString(msg.MessageId), err))
+				continue
+			}
+			replayed++
+		}
+	}
+}
+
+// replayEvent is the payload to invoke the function with to push the batches
+// of the dead-letter sink to Loki again.
+type replayEvent struct {
+	ReplayDeadLetters bool `json:"replay_dead_letters"`
+}
+
+type replayResponse struct {
+	Replayed int `json:"replayed"`
+}
+
+// deadLetterReplayer is implemented by the clients that can send dead letters
+// again.
+type deadLetterReplayer interface {
+	replayDeadLetter(ctx context.Context, letter *deadLetter) error
+}
+
+func processReplayEvent(ctx context.Context, evt *replayEvent, sink deadLetterSink, pc Client, log *log.Logger) (replayResponse, error) {
+	// The event is routed here on the key alone.
+	if !evt.ReplayDeadLetters {
+		return replayResponse{}, errors.New("replay_dead_letters must be true to replay dead letters")
+	}
+	if sink == nil {
+		return replayResponse{}, errors.New("replaying dead letters requires DEAD_LETTER_LOCATION to be set")
+	}
+	replayer, ok := pc.(deadLetterReplayer)
+	if !ok {
+		return replayResponse{}, errors.New("client can't replay dead letters")
+	}
+
+	replayed, err := sink.Replay(ctx, replayer.replayDeadLetter)
+	level.Info(*log).Log("msg", fmt.Sprintf("replayed %d dead letters", replayed)) // nolint:errcheck
+	return replayResponse{Replayed: replayed}, err
+}
+
+// replayDeadLetter sends a dead letter to its destination again, in the format
+// it was encoded with. It isn't written to the dead-letter sink if it fails
+// again.
+func (c *promtailClient) replayDeadLetter(ctx context.Context, letter *deadLetter) error {
+	for _, d := range c.config.destinations {
+		if d.name == letter.Destination {
+			enc := lookupPushEncoder(letter.Format)
+			if enc == nil {
+				return fmt.Errorf("unknown format %s", letter.Format)
+			}
+			// The streams of a letter share the values of the header
+			// templates, so any of them gives the headers.
+			var streamLabels string
+			if len(letter.Streams) > 0 {
+				streamLabels = letter.Streams[0]
+			}
+			headers, err := d.templateHeaders(ctx, letter.TenantID, streamLabels)
+			if err != nil {
+				return err
+			}
+			_, err = c.sendWithRetries(ctx, d, letter.TenantID, headers, enc, letter.Request)
+			return err
+		}
+	}
+	return fmt.Errorf("unknown destination %s", letter.Destination)
+}
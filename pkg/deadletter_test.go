@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/backoff"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+// memDeadLetterSink keeps dead letters in memory.
+type memDeadLetterSink struct {
+	letters []*deadLetter
+}
+
+func (m *memDeadLetterSink) Put(_ context.Context, letter *deadLetter) error {
+	m.letters = append(m.letters, letter)
+	return nil
+}
+
+func (m *memDeadLetterSink) Replay(ctx context.Context, replay func(ctx context.Context, letter *deadLetter) error) (int, error) {
+	var replayed int
+	var left []*deadLetter
+	for _, letter := range m.letters {
+		if err := replay(ctx, letter); err != nil {
+			left = append(left, letter)
+			continue
+		}
+		replayed++
+	}
+	m.letters = left
+	return replayed, nil
+}
+
+func deadLetterClient(t *testing.T, destinationsJSON string, sink deadLetterSink) Client {
+	t.Helper()
+	destinations, err := parseDestinations(context.Background(), &testSecretsClient{}, destinationsJSON)
+	require.NoError(t, err)
+
+	logger := log.NewNopLogger()
+	return NewPromtailClient(&promtailClientConfig{
+		backoff:      &backoff.Config{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 1},
+		http:         &httpClientConfig{timeout: time.Second},
+		destinations: destinations,
+		deadLetters:  sink,
+	}, &logger)
+}
+
+func Test_promtailClient_deadLetters(t *testing.T) {
+	batchSize = 131072
+	keepStream = false
+
+	rejecting := newLokiServer(t, http.StatusBadRequest)
+	sink := &memDeadLetterSink{}
+	client := deadLetterClient(t, `[{"name": "loki", "write_address": "`+rejecting.URL+`", "tenant_id": "team"}]`, sink)
+
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	b, err := newBatch(context.Background(), nil, process,
+		entry{labels: model.LabelSet{"app": "b"}, entry: logproto.Entry{Line: "first", Timestamp: time.Now()}},
+		entry{labels: model.LabelSet{"app": "a"}, entry: logproto.Entry{Line: "second", Timestamp: time.Now()}},
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, client.sendToPromtail(context.Background(), b))
+	require.Len(t, sink.letters, 1)
+	letter := sink.letters[0]
+	require.Equal(t, "loki", letter.Destination)
+	require.Equal(t, "team", letter.TenantID)
+	require.Equal(t, http.StatusBadRequest, letter.Status)
+	require.Equal(t, 2, letter.Entries)
+	require.Equal(t, []string{`{app="a"}`, `{app="b"}`}, letter.Streams)
+	require.NotEmpty(t, letter.Request)
+	require.Equal(t, pushFormatProtobuf, letter.Format)
+
+	// Replaying sends the batch as it was encoded, to the same tenant.
+	loki := newLokiServer(t, http.StatusNoContent)
+	logger := log.NewNopLogger()
+	replayClient := deadLetterClient(t, `[{"name": "loki", "write_address": "`+loki.URL+`"}]`, sink)
+	resp, err := processReplayEvent(context.Background(), &replayEvent{ReplayDeadLetters: true}, sink, replayClient, &logger)
+	require.NoError(t, err)
+	require.Equal(t, 1, resp.Replayed)
+	require.Empty(t, sink.letters)
+	require.Equal(t, []string{`{app="a"}`, `{app="b"}`}, loki.streams)
+	require.Equal(t, []string{"team"}, loki.orgIDs)
+}
+
+func Test_processReplayEvent(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	t.Run("a sink is required", func(t *testing.T) {
+		_, err := processReplayEvent(context.Background(), &replayEvent{ReplayDeadLetters: true}, nil, &failingPromtailClient{}, &logger)
+		require.ErrorContains(t, err, "DEAD_LETTER_LOCATION")
+	})
+
+	t.Run("failed replays stay in the sink", func(t *testing.T) {
+		sink := &memDeadLetterSink{letters: []*deadLetter{{Destination: "unknown"}}}
+		client := deadLetterClient(t, `[{"name": "loki", "write_address": "http://localhost:3100/loki/api/v1/push"}]`, sink)
+		resp, err := processReplayEvent(context.Background(), &replayEvent{ReplayDeadLetters: true}, sink, client, &logger)
+		require.NoError(t, err)
+		require.Equal(t, 0, resp.Replayed)
+		require.Len(t, sink.letters, 1)
+	})
+}
+
+// fakeS3Bucket is an in-memory bucket.
+type fakeS3Bucket struct {
+	objects map[string][]byte
+}
+
+func (f *fakeS3Bucket) GetObject(_ context.Context, params *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	data, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &s3types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (f *fakeS3Bucket) PutObject(_ context.Context, params *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[aws.ToString(params.Key)] = data
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3Bucket) DeleteObject(_ context.Context, params *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	delete(f.objects, aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeS3Bucket) ListObjectsV2(_ context.Context, params *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.ToString(params.Prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	out := &s3.ListObjectsV2Output{}
+	for _, key := range keys {
+		out.Contents = append(out.Contents, s3types.Object{Key: aws.String(key)})
+	}
+	return out, nil
+}
+
+func Test_s3DeadLetterSink(t *testing.T) {
+	bucket := &fakeS3Bucket{objects: map[string][]byte{"other/object": []byte("not a dead letter")}}
+	sink := &s3DeadLetterSink{client: bucket, bucket: "bucket", prefix: "dead-letters"}
+
+	for _, name := range []string{"first", "second"} {
+		require.NoError(t, sink.Put(context.Background(), &deadLetter{Destination: name, Timestamp: time.Now(), Request: []byte(name)}))
+	}
+	require.Len(t, bucket.objects, 3)
+
+	var replayed []string
+	n, err := sink.Replay(context.Background(), func(_ context.Context, letter *deadLetter) error {
+		replayed = append(replayed, string(letter.Request))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.ElementsMatch(t, []string{"first", "second"}, replayed)
+	require.Equal(t, map[string][]byte{"other/object": []byte("not a dead letter")}, bucket.objects)
+}
+
+// fakeSQS is an in-memory queue, where received messages are invisible until
+// deleted.
+type fakeSQS struct {
+	messages  []sqstypes.Message
+	received  int
+	sendCalls int
+}
+
+func (f *fakeSQS) SendMessage(_ context.Context, params *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	f.sendCalls++
+	id := aws.String(strings.Repeat("m", f.sendCalls))
+	f.messages = append(f.messages, sqstypes.Message{MessageId: id, ReceiptHandle: id, Body: params.MessageBody})
+	return &sqs.SendMessageOutput{MessageId: id}, nil
+}
+
+func (f *fakeSQS) ReceiveMessage(_ context.Context, params *sqs.ReceiveMessageInput, _ ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	end := min(f.received+int(params.MaxNumberOfMessages), len(f.messages))
+	out := &sqs.ReceiveMessageOutput{Messages: slices.Clone(f.messages[f.received:end])}
+	f.received = end
+	return out, nil
+}
+
+func (f *fakeSQS) DeleteMessage(_ context.Context, params *sqs.DeleteMessageInput, _ ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	for i, msg := range f.messages {
+		if aws.ToString(msg.ReceiptHandle) == aws.ToString(params.ReceiptHandle) {
+			f.messages = append(f.messages[:i], f.messages[i+1:]...)
+			f.received--
+			break
+		}
+	}
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func Test_sqsDeadLetterSink(t *testing.T) {
+	queue := &fakeSQS{}
+	sink := &sqsDeadLetterSink{client: queue, queueURL: "https://sqs.eu-west-1.amazonaws.com/123456789012/dead-letters"}
+
+	for _, name := range []string{"ok", "failing", "ok"} {
+		require.NoError(t, sink.Put(context.Background(), &deadLetter{Destination: name, Timestamp: time.Now()}))
+	}
+
+	n, err := sink.Replay(context.Background(), func(_ context.Context, letter *deadLetter) error {
+		if letter.Destination == "failing" {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Equal(t, 2, n)
+	require.Len(t, queue.messages, 1)
+	require.Contains(t, aws.ToString(queue.messages[0].Body), `"destination":"failing"`)
+}
+
+func Test_newDeadLetterSink(t *testing.T) {
+	for _, location := range []string{"", "bucket/prefix", "https://example.com/queue", "s3://"} {
+		_, err := newDeadLetterSink(context.Background(), location)
+		require.Error(t, err, location)
+	}
+	require.Equal(t, []string{"https://sqs.eu-west-1.amazonaws.com/123456789012/dead-letters", "eu-west-1"},
+		sqsQueueURLRegex.FindStringSubmatch("https://sqs.eu-west-1.amazonaws.com/123456789012/dead-letters"))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// time left before the Lambda deadline at which processing stops, so that
+	// the lines already parsed can still be flushed
+	deadlineFlushMargin = time.Second
+	// time left before the Lambda deadline at which sending and retrying stop,
+	// so that the invocation returns its error before being killed
+	deadlineSendMargin = 250 * time.Millisecond
+)
+
+// deadlineError is returned when an invocation stops before its deadline
+// without processing the whole event. The event has to be retried, which
+// sends the lines counted in sent again.
+type deadlineError struct {
+	sent int
+	err  error
+}
+
+func (e *deadlineError) Error() string {
+	msg := fmt.Sprintf("stopped before the lambda timeout after sending %d log lines, the event must be retried", e.sent)
+	if e.err != nil {
+		msg += ": " + e.err.Error()
+	}
+	return msg
+}
+
+func (e *deadlineError) Unwrap() error {
+	return e.err
+}
+
+// approachingDeadline reports whether less than margin is left before the
+// deadline of ctx.
+func approachingDeadline(ctx context.Context, margin time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && time.Until(deadline) < margin
+}
+
+// withSendDeadline returns a context that is done deadlineSendMargin before
+// the deadline of ctx, if it has one.
+func withSendDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline.Add(-deadlineSendMargin))
+}
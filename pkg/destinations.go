@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// name of the destination of WRITE_ADDRESS
+const defaultDestinationName = "default"
+
+// destination is a Loki endpoint that batches are pushed to.
+type destination struct {
+	name string
+	// set when the name was generated from the position of the destination
+	unnamed      bool
+	writeAddress *url.URL
+	tenantID     string
+	// nil if they aren't set
+	username, password, bearerToken *secretValue
+	// signs the requests with AWS SigV4, nil to send them unsigned
+	sigv4 *sigv4Signer
+	// fetches the bearer tokens of the requests, nil if there are none
+	oauth2 *oauth2TokenSource
+	// added to the requests, sorted by name
+	headers []*pushHeader
+	// custom CA and client certificate, nil to use the system CAs only
+	tls *tls.Config
+	// streams must match all of them to be sent to the destination
+	matchers []*labels.Matcher
+}
+
+// destinationConfig is an entry of the DESTINATIONS environment variable.
+type destinationConfig struct {
+	Name         string `json:"name"`
+	WriteAddress string `json:"write_address"`
+	TenantID     string `json:"tenant_id,omitempty"`
+	Username     string `json:"username,omitempty"`
+	Password     string `json:"password,omitempty"`
+	BearerToken  string `json:"bearer_token,omitempty"`
+	// signs the requests with the credentials of the Lambda execution role
+	SigV4 *sigv4Config `json:"sigv4,omitempty"`
+	// fetches bearer tokens with the OAuth2 client credentials grant
+	OAuth2 *oauth2Config `json:"oauth2,omitempty"`
+	// header names and values, like the HEADERS environment variable
+	Headers map[string]string `json:"headers,omitempty"`
+	// custom CA and client certificate, like the TLS_* environment variables
+	TLS *destinationTLSConfig `json:"tls,omitempty"`
+	// stream selector, like {__aws_log_type=~"s3_cloudtrail|s3_guardduty"}
+	Match string `json:"match,omitempty"`
+}
+
+// destinationTLSConfig is the tls field of a destination. Each value is
+// PEM-encoded, and can be set to an ARN like the credentials.
+type destinationTLSConfig struct {
+	CACert     string `json:"ca_cert,omitempty"`
+	ClientCert string `json:"client_cert,omitempty"`
+	ClientKey  string `json:"client_key,omitempty"`
+}
+
+// parseDestinations parses the DESTINATIONS environment variable, a JSON array
+// of destinations. Credentials accept a value or an ARN, like their environment
+// variable counterparts.
+func parseDestinations(ctx context.Context, secrets secretFetcher, configJSON string) ([]*destination, error) {
+	if configJSON == "" {
+		return nil, nil
+	}
+
+	var configs []destinationConfig
+	if err := json.Unmarshal([]byte(configJSON), &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse DESTINATIONS: %w", err)
+	}
+
+	// Dead letters and throttles are looked up by name, so names must be
+	// unique, and not the name of WRITE_ADDRESS.
+	names := map[string]bool{defaultDestinationName: true}
+	result := make([]*destination, 0, len(configs))
+	for i, c := range configs {
+		unnamed := c.Name == ""
+		if unnamed {
+			c.Name = fmt.Sprintf("destinations[%d]", i)
+		}
+		if c.Name == defaultDestinationName {
+			return nil, fmt.Errorf("invalid destination %s: the name is reserved for WRITE_ADDRESS", c.Name)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("invalid destination %s: duplicate name", c.Name)
+		}
+		names[c.Name] = true
+
+		d, err := c.toDestination(ctx, secrets)
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination %s: %w", c.Name, err)
+		}
+		d.unnamed = unnamed
+		result = append(result, d)
+	}
+	return result, nil
+}
+
+// requireDestinationNames returns an error if a destination has no name. The
+// generated names change when the destinations are reordered, which would
+// send the dead letters of one to another.
+func requireDestinationNames(destinations []*destination) error {
+	for _, d := range destinations {
+		if d.unnamed {
+			return fmt.Errorf("invalid destination %s: a name is required with DEAD_LETTER_LOCATION", d.name)
+		}
+	}
+	return nil
+}
+
+func (c destinationConfig) toDestination(ctx context.Context, secrets secretFetcher) (*destination, error) {
+	if c.WriteAddress == "" {
+		return nil, errors.New("write_address is required")
+	}
+	writeAddress, err := url.Parse(c.WriteAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &destination{
+		name:         c.Name,
+		writeAddress: writeAddress,
+		tenantID:     c.TenantID,
+	}
+
+	d.username, err = loadSecretValue(ctx, secrets, "username", c.Username)
+	if err != nil {
+		return nil, err
+	}
+	d.password, err = loadSecretValue(ctx, secrets, "password", c.Password)
+	if err != nil {
+		return nil, err
+	}
+	if (d.username != nil) != (d.password != nil) {
+		return nil, errors.New("both username and password must be set if either one is set")
+	}
+	d.bearerToken, err = loadSecretValue(ctx, secrets, "bearer_token", c.BearerToken)
+	if err != nil {
+		return nil, err
+	}
+	if d.username != nil && d.bearerToken != nil {
+		return nil, errors.New("both username and bearer_token are not allowed")
+	}
+	if c.SigV4 != nil {
+		if d.username != nil || d.bearerToken != nil {
+			return nil, errors.New("sigv4 is not allowed with username or bearer_token")
+		}
+		d.sigv4, err = newSigV4Signer(ctx, c.SigV4.Service, c.SigV4.Region)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sigv4: %w", err)
+		}
+	}
+	if c.OAuth2 != nil {
+		if d.username != nil || d.bearerToken != nil || d.sigv4 != nil {
+			return nil, errors.New("oauth2 is not allowed with username, bearer_token or sigv4")
+		}
+		clientSecret, err := loadSecretValue(ctx, secrets, "oauth2 client_secret", c.OAuth2.ClientSecret)
+		if err != nil {
+			return nil, err
+		}
+		d.oauth2, err = newOAuth2TokenSource(c.OAuth2.TokenURL, c.OAuth2.ClientID, clientSecret, c.OAuth2.Scopes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid oauth2: %w", err)
+		}
+	}
+
+	d.headers, err = parseHeaders(ctx, secrets, c.Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.TLS != nil {
+		caCert, err := loadSensitiveValue(ctx, secrets, "tls ca_cert", c.TLS.CACert)
+		if err != nil {
+			return nil, err
+		}
+		clientCert, err := loadSensitiveValue(ctx, secrets, "tls client_cert", c.TLS.ClientCert)
+		if err != nil {
+			return nil, err
+		}
+		clientKey, err := loadSensitiveValue(ctx, secrets, "tls client_key", c.TLS.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		d.tls, err = newTLSConfig(caCert, clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls: %w", err)
+		}
+	}
+
+	if c.Match != "" {
+		d.matchers, err = syntax.ParseMatchers(c.Match, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match %q: %w", c.Match, err)
+		}
+	}
+
+	return d, nil
+}
+
+// filter returns the batch holding the streams of b that match the destination.
+func (d *destination) filter(b *batch) (*batch, error) {
+	if len(d.matchers) == 0 {
+		return b, nil
+	}
+
+	filtered := &batch{streams: map[string]*logproto.Stream{}}
+	for key, stream := range b.streams {
+		ls, err := syntax.ParseLabels(stream.Labels)
+		if err != nil {
+			return nil, err
+		}
+		if d.matches(ls) {
+			filtered.streams[key] = stream
+			if tenantID, ok := b.tenantIDs[key]; ok {
+				if filtered.tenantIDs == nil {
+					filtered.tenantIDs = map[string]string{}
+				}
+				filtered.tenantIDs[key] = tenantID
+			}
+		}
+	}
+	return filtered, nil
+}
+
+// refreshCredentials drops the credentials of a destination that can be
+// fetched again after Loki rejected them with a 401 or 403: the secrets,
+// including the ones of the headers, and the OAuth2 token. It returns false if
+// there are none.
+func (d *destination) refreshCredentials() bool {
+	var refreshed bool
+	secrets := []*secretValue{d.username, d.password, d.bearerToken}
+	for _, h := range d.headers {
+		secrets = append(secrets, h.secret)
+	}
+	for _, s := range secrets {
+		if s.invalidate() {
+			refreshed = true
+		}
+	}
+	if d.oauth2 != nil {
+		d.oauth2.invalidate()
+		refreshed = true
+	}
+	return refreshed
+}
+
+func (d *destination) matches(ls labels.Labels) bool {
+	for _, m := range d.matchers {
+		if !m.Matches(ls.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
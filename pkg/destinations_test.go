@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/grafana/dskit/backoff"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseDestinations(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should resolve credentials and matchers", func(t *testing.T) {
+		secretsClient := &testSecretsClient{
+			ExpectedArn: "arn:aws:secretsmanager:eu-west-1:123456789012:secret:security",
+			ReturnValue: "token",
+		}
+		destinations, err := parseDestinations(ctx, secretsClient, `[
+			{"name": "security", "write_address": "https://security.example.com/loki/api/v1/push", "tenant_id": "security", "bearer_token": "arn:aws:secretsmanager:eu-west-1:123456789012:secret:security", "match": "{__aws_log_type=~\"s3_cloudtrail|s3_guardduty\"}"},
+			{"write_address": "https://staging.example.com/loki/api/v1/push", "username": "user", "password": "pass"}
+		]`)
+		require.NoError(t, err)
+		require.Len(t, destinations, 2)
+
+		require.Equal(t, "security", destinations[0].name)
+		require.Equal(t, "security", destinations[0].tenantID)
+		require.Equal(t, "token", destinations[0].bearerToken.value)
+		require.Len(t, destinations[0].matchers, 1)
+		require.Equal(t, 1, secretsClient.CallsFetchFromAWSSecretsManager)
+
+		require.Equal(t, "destinations[1]", destinations[1].name)
+		require.Equal(t, "staging.example.com", destinations[1].writeAddress.Host)
+		require.Equal(t, "user", destinations[1].username.value)
+		require.Equal(t, "pass", destinations[1].password.value)
+		require.Empty(t, destinations[1].matchers)
+	})
+
+	for name, tc := range map[string]struct {
+		raw     string
+		wantErr string
+	}{
+		"invalid json":          {raw: `{`, wantErr: "failed to parse DESTINATIONS"},
+		"missing write address": {raw: `[{"name": "a"}]`, wantErr: "invalid destination a: write_address is required"},
+		"username only":         {raw: `[{"write_address": "https://a", "username": "user"}]`, wantErr: "both username and password must be set"},
+		"basic and bearer":      {raw: `[{"write_address": "https://a", "username": "user", "password": "pass", "bearer_token": "token"}]`, wantErr: "both username and bearer_token are not allowed"},
+		"invalid match":         {raw: `[{"write_address": "https://a", "match": "{__aws_log_type"}]`, wantErr: "invalid match"},
+		"reserved name":         {raw: `[{"name": "default", "write_address": "https://a"}]`, wantErr: "invalid destination default: the name is reserved for WRITE_ADDRESS"},
+		"duplicate name":        {raw: `[{"name": "a", "write_address": "https://a"}, {"name": "a", "write_address": "https://b"}]`, wantErr: "invalid destination a: duplicate name"},
+		"duplicate generated":   {raw: `[{"write_address": "https://a"}, {"name": "destinations[0]", "write_address": "https://b"}]`, wantErr: "invalid destination destinations[0]: duplicate name"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseDestinations(ctx, &testSecretsClient{}, tc.raw)
+			require.ErrorContains(t, err, tc.wantErr)
+		})
+	}
+}
+
+func Test_requireDestinationNames(t *testing.T) {
+	destinations, err := parseDestinations(context.Background(), &testSecretsClient{}, `[{"name": "a", "write_address": "https://a"}]`)
+	require.NoError(t, err)
+	require.NoError(t, requireDestinationNames(destinations))
+
+	destinations, err = parseDestinations(context.Background(), &testSecretsClient{}, `[{"name": "a", "write_address": "https://a"}, {"write_address": "https://b"}]`)
+	require.NoError(t, err)
+	require.ErrorContains(t, requireDestinationNames(destinations), "invalid destination destinations[1]: a name is required with DEAD_LETTER_LOCATION")
+}
+
+// lokiServer records the streams and headers of the pushes it receives.
+type lokiServer struct {
+	*httptest.Server
+	streams []string
+	orgIDs  []string
+}
+
+func newLokiServer(t *testing.T, status int) *lokiServer {
+	s := &lokiServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		buf, err := snappy.Decode(nil, body)
+		require.NoError(t, err)
+		var req logproto.PushRequest
+		require.NoError(t, proto.Unmarshal(buf, &req))
+		for _, stream := range req.Streams {
+			s.streams = append(s.streams, stream.Labels)
+		}
+		sort.Strings(s.streams)
+		s.orgIDs = append(s.orgIDs, r.Header.Get("X-Scope-OrgID"))
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func Test_promtailClient_fanOut(t *testing.T) {
+	batchSize = 131072
+	keepStream = false
+
+	all := newLokiServer(t, http.StatusNoContent)
+	security := newLokiServer(t, http.StatusNoContent)
+	unmatched := newLokiServer(t, http.StatusNoContent)
+	failing := newLokiServer(t, http.StatusBadRequest)
+
+	destinations, err := parseDestinations(context.Background(), &testSecretsClient{}, `[
+		{"name": "all", "write_address": "`+all.URL+`"},
+		{"name": "security", "write_address": "`+security.URL+`", "tenant_id": "security", "match": "{__aws_log_type=~\"s3_cloudtrail|s3_guardduty\"}"},
+		{"name": "unmatched", "write_address": "`+unmatched.URL+`", "match": "{__aws_log_type=\"s3_waf\"}"},
+		{"name": "failing", "write_address": "`+failing.URL+`"}
+	]`)
+	require.NoError(t, err)
+
+	logger := log.NewNopLogger()
+	client := NewPromtailClient(&promtailClientConfig{
+		backoff:      &backoff.Config{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 1},
+		http:         &httpClientConfig{timeout: time.Second},
+		destinations: destinations,
+	}, &logger)
+
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	b, err := newBatch(context.Background(), nil, process,
+		entry{labels: model.LabelSet{"__aws_log_type": "s3_cloudtrail"}, entry: logproto.Entry{Line: "trail", Timestamp: time.Now()}},
+		entry{labels: model.LabelSet{"__aws_log_type": "s3_lb"}, entry: logproto.Entry{Line: "lb", Timestamp: time.Now()}},
+	)
+	require.NoError(t, err)
+
+	err = client.sendToPromtail(context.Background(), b)
+	require.ErrorContains(t, err, "destination failing")
+
+	require.Equal(t, []string{`{__aws_log_type="s3_cloudtrail"}`, `{__aws_log_type="s3_lb"}`}, all.streams)
+	require.Equal(t, []string{""}, all.orgIDs)
+	require.Equal(t, []string{`{__aws_log_type="s3_cloudtrail"}`}, security.streams)
+	require.Equal(t, []string{"security"}, security.orgIDs)
+	require.Empty(t, unmatched.streams)
+	require.Len(t, failing.orgIDs, 1)
+}
+
+func Test_promtailClient_rotatedSecrets(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			accepted := "Bearer old"
+			var pushes int
+			loki := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				pushes++
+				if r.Header.Get("Authorization") != accepted {
+					w.WriteHeader(status)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer loki.Close()
+
+			secretsClient := &testSecretsClient{ReturnValue: "old"}
+			destinations, err := parseDestinations(context.Background(), secretsClient, `[{"write_address": "`+loki.URL+`", "bearer_token": "arn:aws:secretsmanager:eu-west-1:123456789012:secret:loki"}]`)
+			require.NoError(t, err)
+			logger := log.NewNopLogger()
+			client := NewPromtailClient(&promtailClientConfig{
+				backoff:      &backoff.Config{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 2},
+				http:         &httpClientConfig{timeout: time.Second},
+				destinations: destinations,
+			}, &logger)
+			b := func() *batch {
+				return &batch{streams: map[string]*logproto.Stream{
+					`{app="a"}`: {Labels: `{app="a"}`, Entries: []logproto.Entry{{Timestamp: time.Now(), Line: "hello"}}},
+				}}
+			}
+			require.NoError(t, client.sendToPromtail(context.Background(), b()))
+
+			// The secret is rotated, the push is rejected once and sent again
+			// with the new secret.
+			secretsClient.ReturnValue = "new"
+			accepted = "Bearer new"
+			require.NoError(t, client.sendToPromtail(context.Background(), b()))
+			require.Equal(t, 3, pushes)
+			require.Equal(t, 2, secretsClient.CallsFetchFromAWSSecretsManager)
+
+			// Secrets rejected again aren't fetched a second time.
+			accepted = "Bearer newer"
+			err = client.sendToPromtail(context.Background(), b())
+			require.ErrorContains(t, err, http.StatusText(status))
+			require.Equal(t, 5, pushes)
+			require.Equal(t, 3, secretsClient.CallsFetchFromAWSSecretsManager)
+		})
+	}
+
+	t.Run("pushes with credentials set to their value aren't retried", func(t *testing.T) {
+		loki := newLokiServer(t, http.StatusUnauthorized)
+		destinations, err := parseDestinations(context.Background(), &testSecretsClient{}, `[{"write_address": "`+loki.URL+`", "bearer_token": "token"}]`)
+		require.NoError(t, err)
+		logger := log.NewNopLogger()
+		client := NewPromtailClient(&promtailClientConfig{
+			backoff:      &backoff.Config{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 2},
+			http:         &httpClientConfig{timeout: time.Second},
+			destinations: destinations,
+		}, &logger)
+		b := &batch{streams: map[string]*logproto.Stream{
+			`{app="a"}`: {Labels: `{app="a"}`, Entries: []logproto.Entry{{Timestamp: time.Now(), Line: "hello"}}},
+		}}
+		require.Error(t, client.sendToPromtail(context.Background(), b))
+		require.Len(t, loki.streams, 1)
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+)
+
+const (
+	pushFormatProtobuf = "protobuf"
+	pushFormatJSON     = "json"
+	pushFormatJSONGzip = "json-gzip"
+)
+
+// pushEncoder is a wire format of the push requests sent to Loki, picked with
+// the PUSH_FORMAT environment variable.
+type pushEncoder struct {
+	format          string
+	contentType     string
+	contentEncoding string
+	encode          func(req *logproto.PushRequest) ([]byte, error)
+}
+
+var pushEncoders = []pushEncoder{
+	{
+		// Loki expects snappy block compression without a Content-Encoding.
+		format:      pushFormatProtobuf,
+		contentType: "application/x-protobuf",
+		encode: func(req *logproto.PushRequest) ([]byte, error) {
+			buf, err := proto.Marshal(req)
+			if err != nil {
+				return nil, err
+			}
+			return snappy.Encode(nil, buf), nil
+		},
+	},
+	{
+		format:      pushFormatJSON,
+		contentType: "application/json",
+		encode:      encodeJSONPushRequest,
+	},
+	{
+		format:          pushFormatJSONGzip,
+		contentType:     "application/json",
+		contentEncoding: "gzip",
+		encode: func(req *logproto.PushRequest) ([]byte, error) {
+			buf, err := encodeJSONPushRequest(req)
+			if err != nil {
+				return nil, err
+			}
+			var compressed bytes.Buffer
+			w := gzip.NewWriter(&compressed)
+			if _, err := w.Write(buf); err != nil {
+				return nil, err
+			}
+			if err := w.Close(); err != nil {
+				return nil, err
+			}
+			return compressed.Bytes(), nil
+		},
+	},
+}
+
+// lookupPushEncoder returns the encoder of a PUSH_FORMAT, protobuf if it is
+// empty, or nil if it is unknown.
+func lookupPushEncoder(format string) *pushEncoder {
+	if format == "" {
+		format = pushFormatProtobuf
+	}
+	for i := range pushEncoders {
+		if pushEncoders[i].format == format {
+			return &pushEncoders[i]
+		}
+	}
+	return nil
+}
+
+// encoder returns the encoder of the push requests of the client.
+func (c *promtailClient) encoder() *pushEncoder {
+	return lookupPushEncoder(c.config.pushFormat)
+}
+
+// jsonPushRequest is the JSON body of the Loki push API.
+// source: https://grafana.com/docs/loki/latest/reference/loki-http-api/#ingest-logs
+type jsonPushRequest struct {
+	Streams []jsonPushStream `json:"streams"`
+}
+
+type jsonPushStream struct {
+	Stream map[string]string `json:"stream"`
+	// each value is the timestamp in nanoseconds as a string, the line, and
+	// the structured metadata if there is any
+	Values [][]any `json:"values"`
+}
+
+func encodeJSONPushRequest(req *logproto.PushRequest) ([]byte, error) {
+	body := jsonPushRequest{Streams: make([]jsonPushStream, 0, len(req.Streams))}
+	for _, stream := range req.Streams {
+		ls, err := syntax.ParseLabels(stream.Labels)
+		if err != nil {
+			return nil, fmt.Errorf("invalid labels %s: %w", stream.Labels, err)
+		}
+		s := jsonPushStream{
+			Stream: ls.Map(),
+			Values: make([][]any, 0, len(stream.Entries)),
+		}
+		for _, e := range stream.Entries {
+			value := []any{strconv.FormatInt(e.Timestamp.UnixNano(), 10), e.Line}
+			if len(e.StructuredMetadata) > 0 {
+				metadata := make(map[string]string, len(e.StructuredMetadata))
+				for _, l := range e.StructuredMetadata {
+					metadata[l.Name] = l.Value
+				}
+				value = append(value, metadata)
+			}
+			s.Values = append(s.Values, value)
+		}
+		body.Streams = append(body.Streams, s)
+	}
+	return json.Marshal(body)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/grafana/dskit/backoff"
+	"github.com/grafana/loki/pkg/push"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+)
+
+// decodePushRequest decodes a push request the way Loki does for its
+// Content-Type and Content-Encoding.
+func decodePushRequest(t *testing.T, contentType, contentEncoding string, body []byte) *logproto.PushRequest {
+	t.Helper()
+	if contentEncoding == "gzip" {
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		body, err = io.ReadAll(r)
+		require.NoError(t, err)
+	}
+
+	var req logproto.PushRequest
+	switch contentType {
+	case "application/x-protobuf":
+		buf, err := snappy.Decode(nil, body)
+		require.NoError(t, err)
+		require.NoError(t, proto.Unmarshal(buf, &req))
+	case "application/json":
+		var jsonReq struct {
+			Streams []struct {
+				Stream map[string]string   `json:"stream"`
+				Values [][]json.RawMessage `json:"values"`
+			} `json:"streams"`
+		}
+		require.NoError(t, json.Unmarshal(body, &jsonReq))
+		for _, s := range jsonReq.Streams {
+			stream := logproto.Stream{Labels: labels.FromMap(s.Stream).String()}
+			for _, value := range s.Values {
+				var ts string
+				var e logproto.Entry
+				require.NoError(t, json.Unmarshal(value[0], &ts))
+				ns, err := strconv.ParseInt(ts, 10, 64)
+				require.NoError(t, err)
+				e.Timestamp = time.Unix(0, ns)
+				require.NoError(t, json.Unmarshal(value[1], &e.Line))
+				if len(value) > 2 {
+					var metadata map[string]string
+					require.NoError(t, json.Unmarshal(value[2], &metadata))
+					e.StructuredMetadata = logproto.FromLabelsToLabelAdapters(labels.FromMap(metadata))
+				}
+				stream.Entries = append(stream.Entries, e)
+			}
+			req.Streams = append(req.Streams, stream)
+		}
+	default:
+		t.Fatalf("unexpected Content-Type %q", contentType)
+	}
+	return &req
+}
+
+func Test_pushEncoders(t *testing.T) {
+	ts := time.Unix(0, 1700000000123456789).UTC()
+	b := &batch{streams: map[string]*logproto.Stream{
+		`{app="a", env="prod"}`: {Labels: `{app="a", env="prod"}`, Entries: []logproto.Entry{
+			{Timestamp: ts, Line: `line "1"`},
+			{Timestamp: ts.Add(time.Second), Line: "line 2", StructuredMetadata: push.LabelsAdapter{{Name: "trace_id", Value: "abc"}}},
+		}},
+	}}
+
+	for _, format := range []string{pushFormatProtobuf, pushFormatJSON, pushFormatJSONGzip} {
+		t.Run(format, func(t *testing.T) {
+			enc := lookupPushEncoder(format)
+			require.NotNil(t, enc)
+			buf, count, err := b.encode(enc)
+			require.NoError(t, err)
+			require.Equal(t, 2, count)
+
+			req := decodePushRequest(t, enc.contentType, enc.contentEncoding, buf)
+			require.Len(t, req.Streams, 1)
+			require.Equal(t, `{app="a", env="prod"}`, req.Streams[0].Labels)
+			require.Len(t, req.Streams[0].Entries, 2)
+			for i, e := range req.Streams[0].Entries {
+				want := b.streams[`{app="a", env="prod"}`].Entries[i]
+				require.True(t, want.Timestamp.Equal(e.Timestamp))
+				require.Equal(t, want.Line, e.Line)
+				require.Equal(t, len(want.StructuredMetadata), len(e.StructuredMetadata))
+			}
+			require.Equal(t, "trace_id", req.Streams[0].Entries[1].StructuredMetadata[0].Name)
+			require.Equal(t, "abc", req.Streams[0].Entries[1].StructuredMetadata[0].Value)
+		})
+	}
+
+	require.Equal(t, pushFormatProtobuf, lookupPushEncoder("").format)
+	require.Nil(t, lookupPushEncoder("msgpack"))
+}
+
+func Test_promtailClient_pushFormat(t *testing.T) {
+	for _, format := range []string{pushFormatProtobuf, pushFormatJSON, pushFormatJSONGzip} {
+		t.Run(format, func(t *testing.T) {
+			var lines []string
+			loki := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				req := decodePushRequest(t, r.Header.Get("Content-Type"), r.Header.Get("Content-Encoding"), body)
+				for _, stream := range req.Streams {
+					for _, e := range stream.Entries {
+						lines = append(lines, e.Line)
+					}
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer loki.Close()
+
+			destinations, err := parseDestinations(context.Background(), &testSecretsClient{}, `[{"write_address": "`+loki.URL+`"}]`)
+			require.NoError(t, err)
+			logger := log.NewNopLogger()
+			client := NewPromtailClient(&promtailClientConfig{
+				backoff:      &backoff.Config{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 1},
+				http:         &httpClientConfig{timeout: time.Second},
+				destinations: destinations,
+				pushFormat:   format,
+			}, &logger)
+
+			b := &batch{streams: map[string]*logproto.Stream{
+				`{app="a"}`: {Labels: `{app="a"}`, Entries: []logproto.Entry{{Timestamp: time.Now(), Line: "hello"}}},
+			}}
+			require.NoError(t, client.sendToPromtail(context.Background(), b))
+			require.Equal(t, []string{"hello"}, lines)
+		})
+	}
+}
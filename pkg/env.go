@@ -4,13 +4,19 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 )
 
 type secretFetcher interface {
 	FetchFromAWSSecretsManager(ctx context.Context, secretArn string) (string, error)
 	FetchFromAWSSSMParameterStore(ctx context.Context, parameterArn string) (string, error)
+	FetchFromS3(ctx context.Context, uri string) (string, error)
 }
 
 func loadSensitiveEnv(ctx context.Context, secrets secretFetcher, name string) (string, error) {
@@ -19,21 +25,117 @@ func loadSensitiveEnv(ctx context.Context, secrets secretFetcher, name string) (
 		return "", nil
 	}
 
-	if arn.IsARN(envValue) {
-		parsedArn, err := arn.Parse(envValue)
+	return loadSensitiveValue(ctx, secrets, "environment variable "+name, envValue)
+}
+
+// loadSensitiveValue resolves a setting that is either the value itself or the
+// ARN of a Secrets Manager secret or SSM parameter. name describes the setting
+// in errors.
+func loadSensitiveValue(ctx context.Context, secrets secretFetcher, name, value string) (string, error) {
+	if arn.IsARN(value) {
+		parsedArn, err := arn.Parse(value)
 		if err != nil {
 			return "", fmt.Errorf("error parsing arn: %w", err)
 		}
 
 		switch parsedArn.Service {
 		case "secretsmanager":
-			return secrets.FetchFromAWSSecretsManager(ctx, envValue)
+			return secrets.FetchFromAWSSecretsManager(ctx, value)
 		case "ssm":
-			return secrets.FetchFromAWSSSMParameterStore(ctx, envValue)
+			return secrets.FetchFromAWSSSMParameterStore(ctx, value)
 		default:
-			return "", fmt.Errorf("environment variable %s set to invalid ARN (unsupported service %s)", name, parsedArn.Service)
+			return "", fmt.Errorf("%s set to invalid ARN (unsupported service %s)", name, parsedArn.Service)
 		}
 	}
 
-	return envValue, nil
+	return value, nil
+}
+
+// secretValue is a credential set either to its value or to the ARN of a
+// Secrets Manager secret or SSM parameter. Secrets are fetched again once
+// SECRET_CACHE_TTL elapsed, or after Loki rejected them, so that warm
+// containers pick up rotated secrets.
+type secretValue struct {
+	secrets secretFetcher
+	name    string
+	// ARN of the secret, empty if the credential is set to its value
+	arn string
+
+	mu      sync.Mutex
+	value   string
+	fetched time.Time
+	// set once Loki rejected the value
+	stale bool
+}
+
+// loadSecretEnv is like loadSensitiveEnv, but keeps the ARN to fetch the
+// secret again. It returns nil if the environment variable isn't set.
+func loadSecretEnv(ctx context.Context, secrets secretFetcher, name string) (*secretValue, error) {
+	return loadSecretValue(ctx, secrets, "environment variable "+name, os.Getenv(name))
+}
+
+// loadSecretValue is like loadSensitiveValue, but keeps the ARN to fetch the
+// secret again. It returns nil if value is empty.
+func loadSecretValue(ctx context.Context, secrets secretFetcher, name, value string) (*secretValue, error) {
+	if value == "" {
+		return nil, nil
+	}
+	resolved, err := loadSensitiveValue(ctx, secrets, name, value)
+	if err != nil {
+		return nil, err
+	}
+	s := &secretValue{secrets: secrets, name: name, value: resolved, fetched: time.Now()}
+	if arn.IsARN(value) {
+		s.arn = value
+	}
+	return s, nil
+}
+
+// get returns the value of the credential, fetching the secret again if it
+// expired or was rejected. When fetching an expired secret fails, the cached
+// value is still valid as far as anyone knows, so it is used until the next
+// attempt, one SECRET_CACHE_TTL later. Only a rejected secret fails.
+func (s *secretValue) get(ctx context.Context, log *log.Logger) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := secretCacheTTL > 0 && time.Since(s.fetched) >= secretCacheTTL
+	if s.arn == "" || (!s.stale && !expired) {
+		return s.value, nil
+	}
+	value, err := loadSensitiveValue(ctx, s.secrets, s.name, s.arn)
+	if err != nil {
+		if s.stale {
+			return "", err
+		}
+		level.Warn(*log).Log("msg", fmt.Sprintf("failed to fetch %s again, using the cached value", s.name), "err", err) // nolint:errcheck
+		s.fetched = time.Now()
+		return s.value, nil
+	}
+	s.value = value
+	s.fetched = time.Now()
+	s.stale = false
+	return s.value, nil
+}
+
+// invalidate marks the secret as rejected, for the next request to fetch it
+// again. It returns false if the credential isn't a secret.
+func (s *secretValue) invalidate() bool {
+	if s == nil || s.arn == "" {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stale = true
+	return true
+}
+
+// loadConfigEnv is like loadSensitiveEnv, but also accepts an s3://bucket/key
+// URI for configuration documents too large for an environment variable.
+func loadConfigEnv(ctx context.Context, secrets secretFetcher, name string) (string, error) {
+	envValue, ok := os.LookupEnv(name)
+	if ok && strings.HasPrefix(envValue, "s3://") {
+		return secrets.FetchFromS3(ctx, envValue)
+	}
+	return loadSensitiveEnv(ctx, secrets, name)
 }
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"testing"
+	"time"
 
+	"github.com/go-kit/log"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -73,3 +76,113 @@ func Test_loadSensitiveEnv(t *testing.T) {
 		assert.Equal(t, 1, secretsClient.CallsFetchFromAWSSSMParameterStore)
 	})
 }
+
+func Test_loadConfigEnv(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should call FetchFromS3 if the env variable contains an S3 URI", func(t *testing.T) {
+		t.Setenv("FOO", "s3://my-bucket/config.yaml")
+		secretsClient := &testSecretsClient{
+			ExpectedArn: "s3://my-bucket/config.yaml",
+			ReturnValue: "bar",
+		}
+
+		value, err := loadConfigEnv(ctx, secretsClient, "FOO")
+		assert.NoError(t, err)
+		assert.Equal(t, "bar", value)
+		assert.Equal(t, 1, secretsClient.CallsFetchFromS3)
+		assert.Equal(t, 0, secretsClient.CallsFetchFromAWSSSMParameterStore)
+	})
+
+	t.Run("should fall back to loadSensitiveEnv otherwise", func(t *testing.T) {
+		t.Setenv("FOO", "arn:aws:ssm:eu-west-1:123456789012:parameter/foo")
+		secretsClient := &testSecretsClient{
+			ReturnValue: "bar",
+		}
+
+		value, err := loadConfigEnv(ctx, secretsClient, "FOO")
+		assert.NoError(t, err)
+		assert.Equal(t, "bar", value)
+		assert.Equal(t, 0, secretsClient.CallsFetchFromS3)
+		assert.Equal(t, 1, secretsClient.CallsFetchFromAWSSSMParameterStore)
+	})
+}
+
+func Test_secretValue(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	defer func(ttl time.Duration) { secretCacheTTL = ttl }(secretCacheTTL)
+	secretCacheTTL = time.Hour
+
+	t.Run("values aren't fetched again", func(t *testing.T) {
+		secretsClient := &testSecretsClient{}
+		s, err := loadSecretValue(ctx, secretsClient, "password", "pass")
+		assert.NoError(t, err)
+		assert.False(t, s.invalidate())
+
+		value, err := s.get(ctx, &logger)
+		assert.NoError(t, err)
+		assert.Equal(t, "pass", value)
+		assert.Equal(t, 0, secretsClient.CallsFetchFromAWSSecretsManager)
+	})
+
+	t.Run("unset values are nil", func(t *testing.T) {
+		s, err := loadSecretValue(ctx, &testSecretsClient{}, "password", "")
+		assert.NoError(t, err)
+		assert.Nil(t, s)
+		assert.False(t, s.invalidate())
+	})
+
+	t.Run("rejected secrets are fetched again", func(t *testing.T) {
+		secretsClient := &testSecretsClient{ReturnValue: "old"}
+		s, err := loadSecretValue(ctx, secretsClient, "password", "arn:aws:secretsmanager:eu-west-1:123456789012:secret:foo")
+		assert.NoError(t, err)
+
+		secretsClient.ReturnValue = "new"
+		value, err := s.get(ctx, &logger)
+		assert.NoError(t, err)
+		assert.Equal(t, "old", value)
+
+		assert.True(t, s.invalidate())
+		value, err = s.get(ctx, &logger)
+		assert.NoError(t, err)
+		assert.Equal(t, "new", value)
+		assert.Equal(t, 2, secretsClient.CallsFetchFromAWSSecretsManager)
+	})
+
+	t.Run("expired secrets are fetched again", func(t *testing.T) {
+		secretCacheTTL = time.Millisecond
+		secretsClient := &testSecretsClient{ReturnValue: "old"}
+		s, err := loadSecretValue(ctx, secretsClient, "password", "arn:aws:ssm:eu-west-1:123456789012:parameter/foo")
+		assert.NoError(t, err)
+
+		secretsClient.ReturnValue = "new"
+		time.Sleep(2 * time.Millisecond)
+		value, err := s.get(ctx, &logger)
+		assert.NoError(t, err)
+		assert.Equal(t, "new", value)
+		assert.Equal(t, 2, secretsClient.CallsFetchFromAWSSSMParameterStore)
+	})
+
+	t.Run("expired secrets are kept if fetching them fails", func(t *testing.T) {
+		secretCacheTTL = time.Millisecond
+		secretsClient := &testSecretsClient{ReturnValue: "old"}
+		s, err := loadSecretValue(ctx, secretsClient, "password", "arn:aws:secretsmanager:eu-west-1:123456789012:secret:foo")
+		assert.NoError(t, err)
+
+		var logs bytes.Buffer
+		logger := log.NewLogfmtLogger(&logs)
+		secretsClient.ExpectedArn = "arn:aws:secretsmanager:eu-west-1:123456789012:secret:other"
+		time.Sleep(2 * time.Millisecond)
+		value, err := s.get(ctx, &logger)
+		assert.NoError(t, err)
+		assert.Equal(t, "old", value)
+		assert.Equal(t, 2, secretsClient.CallsFetchFromAWSSecretsManager)
+		assert.Contains(t, logs.String(), "failed to fetch password again, using the cached value")
+
+		// Rejected secrets aren't.
+		assert.True(t, s.invalidate())
+		_, err = s.get(ctx, &logger)
+		assert.ErrorIs(t, err, errInvalidArn)
+	})
+}
@@ -47,10 +47,14 @@ func eventTarget(ev map[string]any) (any, error) {
 		return &events.CloudwatchLogsEvent{}, nil
 	case hasKey(ev, "detail-type") || hasKey(ev, "detail"):
 		return &events.CloudWatchEvent{}, nil
+	case hasKey(ev, "deliveryStreamArn"):
+		return &events.KinesisFirehoseEvent{}, nil
 	case hasKey(ev, "Records"):
 		return recordEventTarget(ev)
 	case isS3TestEvent(ev):
 		return &events.S3TestEvent{}, nil
+	case hasKey(ev, "replay_dead_letters"):
+		return &replayEvent{}, nil
 	}
 	return nil, fmt.Errorf("unknown event type: %v", ev)
 }
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"os"
 	"testing"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/go-kit/log"
 	"github.com/stretchr/testify/require"
 )
 
@@ -50,6 +52,11 @@ func Test_checkEventType(t *testing.T) {
 			file: "../testdata/events/kinesis-event.json",
 			want: &events.KinesisEvent{},
 		},
+		{
+			name: "firehose event",
+			file: "../testdata/events/kinesis-firehose-event.json",
+			want: &events.KinesisFirehoseEvent{},
+		},
 		{
 			name: "cloudwatch logs event",
 			file: "../testdata/events/cloudwatch-logs-event.json",
@@ -115,3 +122,22 @@ func Test_checkEventType_unknownRecordSource(t *testing.T) {
 	_, err := checkEventType(ev)
 	require.Error(t, err)
 }
+
+func Test_checkEventType_replayEvent(t *testing.T) {
+	got, err := checkEventType(map[string]any{"replay_dead_letters": true})
+	require.NoError(t, err)
+	require.Equal(t, &replayEvent{ReplayDeadLetters: true}, got)
+}
+
+func Test_checkEventType_replayEventFalse(t *testing.T) {
+	got, err := checkEventType(map[string]any{"replay_dead_letters": false})
+	require.NoError(t, err)
+	require.Equal(t, &replayEvent{ReplayDeadLetters: false}, got)
+
+	// Nothing is replayed, even with a sink.
+	sink := &memDeadLetterSink{letters: []*deadLetter{{Destination: "loki"}}}
+	logger := log.NewNopLogger()
+	_, err = processReplayEvent(context.Background(), got.(*replayEvent), sink, &failingPromtailClient{}, &logger)
+	require.ErrorContains(t, err, "replay_dead_letters must be true")
+	require.Len(t, sink.letters, 1)
+}
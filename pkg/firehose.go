@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+
+	"github.com/grafana/loki/pkg/push"
+)
+
+// messageType of the records CloudWatch Logs sends to check that it can write
+// to a subscription destination
+const cloudwatchControlMessage = "CONTROL_MESSAGE"
+
+// processFirehoseEvent sends the records of an Amazon Data Firehose data
+// transformation event to Loki and reports the outcome of each record back to
+// Firehose. Records are passed through unchanged to the Firehose destination.
+// https://docs.aws.amazon.com/firehose/latest/dev/data-transformation.html
+func processFirehoseEvent(ctx context.Context, ev *events.KinesisFirehoseEvent, pClient Client, processingPipeline *LokiStages, log *log.Logger) (events.KinesisFirehoseResponse, error) {
+	resp := events.KinesisFirehoseResponse{
+		Records: make([]events.KinesisFirehoseResponseRecord, 0, len(ev.Records)),
+	}
+	batch, err := newBatch(ctx, pClient, processingPipeline)
+	if err != nil {
+		return resp, err
+	}
+	// The records that failed are tracked by what was flushed, which requires
+	// each flush to be sent before adding more entries.
+	batch.sender = nil
+
+	results := make([]string, len(ev.Records))
+	// index of the first record whose log events may not have reached Loki yet
+	pending := 0
+	for i, record := range ev.Records {
+		if batch.size == 0 {
+			pending = i
+		}
+		results[i] = events.KinesisFirehoseTransformedStateOk
+
+		// err is kept for the send failures, which fail the records after it.
+		recordData, decodeErr := decodeFirehoseRecord(record)
+		if decodeErr != nil {
+			level.Error(*log).Log("msg", fmt.Sprintf("failed to decode firehose record %s", record.RecordID), "err", decodeErr) // nolint:errcheck
+			results[i] = events.KinesisFirehoseTransformedStateProcessingFailed
+			continue
+		}
+
+		labels, metadata := createFirehoseLabels(ev, record, recordData)
+		if err = processLogEvents(ctx, batch, recordData.LogEvents, labels, metadata); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = batch.flushBatch(ctx)
+	}
+	if err != nil {
+		level.Error(*log).Log("msg", "failed to send firehose records", "err", err) // nolint:errcheck
+		for i := pending; i < len(results); i++ {
+			results[i] = events.KinesisFirehoseTransformedStateProcessingFailed
+		}
+	}
+	// A record must never be reported without a result.
+	for i := range results {
+		if results[i] == "" {
+			results[i] = events.KinesisFirehoseTransformedStateProcessingFailed
+		}
+	}
+
+	for i, record := range ev.Records {
+		resp.Records = append(resp.Records, events.KinesisFirehoseResponseRecord{
+			RecordID: record.RecordID,
+			Result:   results[i],
+			Data:     record.Data,
+		})
+	}
+	return resp, nil
+}
+
+// decodeFirehoseRecord returns the CloudWatch Logs subscription payload of a
+// Firehose record. Any other payload is wrapped as a single log event, with no
+// log group set. The control messages CloudWatch Logs sends to check the
+// delivery stream are returned without log events.
+func decodeFirehoseRecord(record events.KinesisFirehoseEventRecord) (events.CloudwatchLogsData, error) {
+	data, err := decompressData(record.Data)
+	if err != nil {
+		return events.CloudwatchLogsData{}, fmt.Errorf("error decompressing data: %w", err)
+	}
+
+	var recordData events.CloudwatchLogsData
+	if err := json.Unmarshal(data, &recordData); err == nil {
+		if recordData.MessageType == cloudwatchControlMessage {
+			return events.CloudwatchLogsData{MessageType: recordData.MessageType}, nil
+		}
+		if recordData.LogGroup != "" {
+			return recordData, nil
+		}
+	}
+
+	return events.CloudwatchLogsData{
+		LogEvents: []events.CloudwatchLogsLogEvent{{
+			ID:        record.RecordID,
+			Timestamp: record.ApproximateArrivalTimestamp.UnixMilli(),
+			Message:   strings.TrimRight(string(data), "\n"),
+		}},
+	}, nil
+}
+
+func createFirehoseLabels(ev *events.KinesisFirehoseEvent, record events.KinesisFirehoseEventRecord, recordData events.CloudwatchLogsData) (model.LabelSet, push.LabelsAdapter) {
+	labels := model.LabelSet{
+		model.LabelName("__aws_log_type"):                     model.LabelValue("firehose"),
+		model.LabelName("__aws_firehose_delivery_stream_arn"): model.LabelValue(ev.DeliveryStreamArn),
+	}
+
+	if recordData.LogGroup != "" {
+		labels[model.LabelName("__aws_cloudwatch_log_group")] = model.LabelValue(recordData.LogGroup)
+		labels[model.LabelName("__aws_cloudwatch_owner")] = model.LabelValue(recordData.Owner)
+		if keepStream {
+			labels[model.LabelName("__aws_cloudwatch_log_stream")] = model.LabelValue(recordData.LogStream)
+		}
+	}
+
+	metadata := structuredMetadata(labels, model.LabelSet{
+		model.LabelName("__aws_cloudwatch_log_stream"): model.LabelValue(recordData.LogStream),
+		model.LabelName("__aws_firehose_record_id"):    model.LabelValue(record.RecordID),
+	})
+
+	return applyLabels(labels), metadata
+}
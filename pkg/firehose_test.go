@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func firehoseRecord(id string, data []byte) events.KinesisFirehoseEventRecord {
+	return events.KinesisFirehoseEventRecord{
+		RecordID:                    id,
+		ApproximateArrivalTimestamp: events.MilliSecondsEpochTime{Time: time.UnixMilli(1507217624302)},
+		Data:                        data,
+	}
+}
+
+// controlMessage is what CloudWatch Logs sends to check a subscription
+// destination, with an empty log group.
+const controlMessage = `{"messageType":"CONTROL_MESSAGE","owner":"CloudwatchLogs","logGroup":"","logStream":"","subscriptionFilters":[],"logEvents":[{"id":"","timestamp":1507217624302,"message":"CWL CONTROL MESSAGE: Checking health of destination Firehose."}]}`
+
+func Test_processFirehoseEvent(t *testing.T) {
+	batchSize = 131072 // Set large enough we only send once
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	logger := log.NewNopLogger()
+
+	ev := &events.KinesisFirehoseEvent{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:123456789012:deliverystream/test",
+		Records: []events.KinesisFirehoseEventRecord{
+			firehoseRecord("cloudwatch", gzipCloudwatchLogsData(t, "a", "b")),
+			firehoseRecord("raw", []byte("Hello World\n")),
+			firehoseRecord("corrupt", []byte{0x1f, 0x8b, 0x00}),
+			firehoseRecord("control", gzipData(t, []byte(controlMessage))),
+		},
+	}
+
+	t.Run("per record results", func(t *testing.T) {
+		client := &failingPromtailClient{}
+		resp, err := processFirehoseEvent(context.Background(), ev, client, process, &logger)
+		require.NoError(t, err)
+		require.Equal(t, 3, client.sent, "control messages aren't sent")
+		require.Len(t, resp.Records, 4)
+
+		require.Equal(t, "cloudwatch", resp.Records[0].RecordID)
+		require.Equal(t, events.KinesisFirehoseTransformedStateOk, resp.Records[0].Result)
+		require.Equal(t, ev.Records[0].Data, resp.Records[0].Data)
+		require.Equal(t, events.KinesisFirehoseTransformedStateOk, resp.Records[1].Result)
+		require.Equal(t, events.KinesisFirehoseTransformedStateProcessingFailed, resp.Records[2].Result)
+		require.Equal(t, events.KinesisFirehoseTransformedStateOk, resp.Records[3].Result)
+	})
+
+	t.Run("send failure", func(t *testing.T) {
+		client := &failingPromtailClient{err: errors.New("server returned HTTP status 500")}
+		resp, err := processFirehoseEvent(context.Background(), ev, client, process, &logger)
+		require.NoError(t, err)
+		for _, record := range resp.Records {
+			require.Equal(t, events.KinesisFirehoseTransformedStateProcessingFailed, record.Result)
+		}
+	})
+}
+
+// flakyPromtailClient fails every send after the first ok ones.
+type flakyPromtailClient struct {
+	ok, sends int
+}
+
+func (c *flakyPromtailClient) sendToPromtail(_ context.Context, _ *batch) error {
+	c.sends++
+	if c.sends > c.ok {
+		return errors.New("server returned HTTP status 500")
+	}
+	return nil
+}
+
+func Test_processFirehoseEvent_failureMidBatch(t *testing.T) {
+	defer func(size int) { batchSize = size }(batchSize)
+	batchSize = 1 // Send each record on its own
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	logger := log.NewNopLogger()
+
+	ev := &events.KinesisFirehoseEvent{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:123456789012:deliverystream/test",
+		Records: []events.KinesisFirehoseEventRecord{
+			firehoseRecord("1", []byte("one")),
+			firehoseRecord("2", []byte("two")),
+			firehoseRecord("3", []byte("three")),
+			firehoseRecord("4", []byte("four")),
+		},
+	}
+	client := &flakyPromtailClient{ok: 1}
+	resp, err := processFirehoseEvent(context.Background(), ev, client, process, &logger)
+	require.NoError(t, err)
+	require.Equal(t, 2, client.sends, "processing stops at the first failure")
+	require.Len(t, resp.Records, 4)
+	require.Equal(t, events.KinesisFirehoseTransformedStateOk, resp.Records[0].Result)
+	for _, record := range resp.Records[1:] {
+		require.Equal(t, events.KinesisFirehoseTransformedStateProcessingFailed, record.Result, "record %s", record.RecordID)
+	}
+}
+
+func Test_decodeFirehoseRecord(t *testing.T) {
+	keepStream = false
+	ev := &events.KinesisFirehoseEvent{DeliveryStreamArn: "arn:aws:firehose:us-east-1:123456789012:deliverystream/test"}
+
+	record := firehoseRecord("cloudwatch", gzipCloudwatchLogsData(t, "a"))
+	recordData, err := decodeFirehoseRecord(record)
+	require.NoError(t, err)
+	require.Len(t, recordData.LogEvents, 1)
+	require.Equal(t, "a", recordData.LogEvents[0].Message)
+	labels, _ := createFirehoseLabels(ev, record, recordData)
+	require.Equal(t, `{__aws_cloudwatch_log_group="test-group", __aws_cloudwatch_owner="123456789012", __aws_firehose_delivery_stream_arn="arn:aws:firehose:us-east-1:123456789012:deliverystream/test", __aws_log_type="firehose"}`, labelsMapToString(labels))
+
+	record = firehoseRecord("raw", []byte("Hello World\n"))
+	recordData, err = decodeFirehoseRecord(record)
+	require.NoError(t, err)
+	require.Equal(t, []events.CloudwatchLogsLogEvent{{ID: "raw", Timestamp: 1507217624302, Message: "Hello World"}}, recordData.LogEvents)
+	labels, _ = createFirehoseLabels(ev, record, recordData)
+	require.Equal(t, `{__aws_firehose_delivery_stream_arn="arn:aws:firehose:us-east-1:123456789012:deliverystream/test", __aws_log_type="firehose"}`, labelsMapToString(labels))
+
+	for _, data := range [][]byte{gzipData(t, []byte(controlMessage)), []byte(controlMessage)} {
+		recordData, err = decodeFirehoseRecord(firehoseRecord("control", data))
+		require.NoError(t, err)
+		require.Empty(t, recordData.LogEvents)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/go-kit/log"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+)
+
+// headers the function sets itself, which can't be set in HEADERS
+var reservedHeaders = []string{"Authorization", "Content-Encoding", "Content-Length", "Content-Type", "Host", "X-Scope-Orgid"}
+
+// pushHeader is an HTTP header added to the push requests to a destination,
+// from the HEADERS environment variable or the headers field of DESTINATIONS.
+type pushHeader struct {
+	name string
+	// set for static values and secrets, nil for templates
+	secret   *secretValue
+	template *template.Template
+}
+
+// headerTemplateData is what header templates are executed with.
+type headerTemplateData struct {
+	FunctionARN     string
+	FunctionName    string
+	FunctionVersion string
+	RequestID       string
+	Region          string
+	Destination     string
+	TenantID        string
+	// labels of the stream, after relabeling and pipeline stages
+	Labels map[string]string
+}
+
+// parseHeadersJSON parses a JSON object of header names and values.
+func parseHeadersJSON(ctx context.Context, secrets secretFetcher, configJSON string) ([]*pushHeader, error) {
+	if configJSON == "" {
+		return nil, nil
+	}
+	var config map[string]string
+	if err := json.Unmarshal([]byte(configJSON), &config); err != nil {
+		return nil, fmt.Errorf("failed to parse HEADERS: %w", err)
+	}
+	return parseHeaders(ctx, secrets, config)
+}
+
+// parseHeaders parses the headers of a destination. Values containing {{ are
+// templates executed with headerTemplateData for every stream, the others are
+// a value or an ARN, like the credentials.
+func parseHeaders(ctx context.Context, secrets secretFetcher, config map[string]string) ([]*pushHeader, error) {
+	result := make([]*pushHeader, 0, len(config))
+	for name, value := range config {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name == "" {
+			return nil, errors.New("header names can't be empty")
+		}
+		for _, reserved := range reservedHeaders {
+			if name == reserved {
+				return nil, fmt.Errorf("header %s is set by the function and can't be overridden", name)
+			}
+		}
+
+		h := &pushHeader{name: name}
+		if strings.Contains(value, "{{") {
+			// A label the stream doesn't have renders as an empty value.
+			tmpl, err := template.New(name).Option("missingkey=zero").Parse(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid template of header %s: %w", name, err)
+			}
+			// Catch the unknown fields before the first request.
+			if err := tmpl.Execute(&bytes.Buffer{}, &headerTemplateData{}); err != nil {
+				return nil, fmt.Errorf("invalid template of header %s: %w", name, err)
+			}
+			h.template = tmpl
+		} else {
+			var err error
+			h.secret, err = loadSecretValue(ctx, secrets, "header "+name, value)
+			if err != nil {
+				return nil, err
+			}
+			if h.secret == nil {
+				return nil, fmt.Errorf("header %s has no value", name)
+			}
+		}
+		result = append(result, h)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].name < result[j].name })
+	return result, nil
+}
+
+func newHeaderTemplateData(ctx context.Context, d *destination, tenantID string) *headerTemplateData {
+	data := &headerTemplateData{
+		FunctionName:    lambdacontext.FunctionName,
+		FunctionVersion: lambdacontext.FunctionVersion,
+		Region:          os.Getenv("AWS_REGION"),
+		Destination:     d.name,
+		TenantID:        tenantID,
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		data.FunctionARN = lc.InvokedFunctionArn
+		data.RequestID = lc.AwsRequestID
+	}
+	return data
+}
+
+// headerBatch is the part of a batch whose streams give the header templates
+// of a destination the same values.
+type headerBatch struct {
+	// values of the header templates, nil if there are none
+	headers http.Header
+	batch   *batch
+}
+
+// headerBatches splits a batch by the values of the header templates of d,
+// which can depend on the labels of each stream. The streams of each part are
+// sent in a request of their own.
+func (d *destination) headerBatches(ctx context.Context, tenantID string, b *batch) ([]headerBatch, error) {
+	if !slices.ContainsFunc(d.headers, func(h *pushHeader) bool { return h.template != nil }) {
+		return []headerBatch{{batch: b}}, nil
+	}
+
+	batches := map[string]*headerBatch{}
+	for key, stream := range b.streams {
+		headers, err := d.templateHeaders(ctx, tenantID, stream.Labels)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]string, 0, len(headers))
+		for _, name := range slices.Sorted(maps.Keys(headers)) {
+			values = append(values, name+": "+headers.Get(name))
+		}
+		group := strings.Join(values, "\n")
+		hb, ok := batches[group]
+		if !ok {
+			hb = &headerBatch{headers: headers, batch: &batch{streams: map[string]*logproto.Stream{}}}
+			batches[group] = hb
+		}
+		hb.batch.streams[key] = stream
+	}
+
+	result := make([]headerBatch, 0, len(batches))
+	for _, group := range slices.Sorted(maps.Keys(batches)) {
+		result = append(result, *batches[group])
+	}
+	return result, nil
+}
+
+// templateHeaders executes the header templates of d for a stream. It returns
+// nil if there are none.
+func (d *destination) templateHeaders(ctx context.Context, tenantID, streamLabels string) (http.Header, error) {
+	var (
+		headers http.Header
+		data    *headerTemplateData
+	)
+	for _, h := range d.headers {
+		if h.template == nil {
+			continue
+		}
+		if data == nil {
+			data = newHeaderTemplateData(ctx, d, tenantID)
+			if streamLabels != "" {
+				ls, err := syntax.ParseLabels(streamLabels)
+				if err != nil {
+					return nil, err
+				}
+				data.Labels = ls.Map()
+			}
+			headers = http.Header{}
+		}
+		var value strings.Builder
+		if err := h.template.Execute(&value, data); err != nil {
+			return nil, fmt.Errorf("error executing the template of header %s: %w", h.name, err)
+		}
+		headers.Set(h.name, value.String())
+	}
+	return headers, nil
+}
+
+// setHeaders adds the headers of a destination to a request, with the values
+// of its templates from templateHeaders.
+func (d *destination) setHeaders(ctx context.Context, req *http.Request, templated http.Header, log *log.Logger) error {
+	for _, h := range d.headers {
+		if h.template != nil {
+			req.Header.Set(h.name, templated.Get(h.name))
+			continue
+		}
+		value, err := h.secret.get(ctx, log)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(h.name, value)
+	}
+	return nil
+}
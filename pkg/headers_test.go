@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/backoff"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseHeaders(t *testing.T) {
+	secretsClient := &testSecretsClient{ReturnValue: "key"}
+	headers, err := parseHeadersJSON(context.Background(), secretsClient, `{
+		"x-api-key": "arn:aws:secretsmanager:eu-west-1:123456789012:secret:api-key",
+		"X-Route": "logs",
+		"X-Invocation": "{{ .FunctionName }}/{{ .RequestID }}"
+	}`)
+	require.NoError(t, err)
+	require.Len(t, headers, 3)
+	require.Equal(t, 1, secretsClient.CallsFetchFromAWSSecretsManager)
+
+	require.Equal(t, "X-Api-Key", headers[0].name)
+	require.Equal(t, "key", headers[0].secret.value)
+	require.Equal(t, "X-Invocation", headers[1].name)
+	require.NotNil(t, headers[1].template)
+	require.Equal(t, "X-Route", headers[2].name)
+	require.Equal(t, "logs", headers[2].secret.value)
+
+	for name, tc := range map[string]struct {
+		raw     string
+		wantErr string
+	}{
+		"invalid json":      {raw: `["X-Route"]`, wantErr: "failed to parse HEADERS"},
+		"reserved header":   {raw: `{"x-scope-orgid": "tenant"}`, wantErr: "header X-Scope-Orgid is set by the function"},
+		"empty value":       {raw: `{"X-Route": ""}`, wantErr: "header X-Route has no value"},
+		"invalid template":  {raw: `{"X-Route": "{{ .RequestID"}`, wantErr: "invalid template of header X-Route"},
+		"unknown field":     {raw: `{"X-Route": "{{ .Stream }}"}`, wantErr: "invalid template of header X-Route"},
+		"empty header name": {raw: `{" ": "logs"}`, wantErr: "header names can't be empty"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseHeadersJSON(context.Background(), &testSecretsClient{}, tc.raw)
+			require.ErrorContains(t, err, tc.wantErr)
+		})
+	}
+}
+
+func Test_promtailClient_headers(t *testing.T) {
+	defer func(name string) { lambdacontext.FunctionName = name }(lambdacontext.FunctionName)
+	lambdacontext.FunctionName = "lambda-promtail"
+
+	var headers http.Header
+	loki := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer loki.Close()
+
+	destinations, err := parseDestinations(context.Background(), &testSecretsClient{}, `[{
+		"name": "gateway",
+		"write_address": "`+loki.URL+`",
+		"tenant_id": "team",
+		"headers": {
+			"X-Api-Key": "key",
+			"X-Invocation": "{{ .FunctionName }}/{{ .RequestID }}",
+			"X-Route": "{{ .Destination }}-{{ .TenantID }}"
+		}
+	}]`)
+	require.NoError(t, err)
+	logger := log.NewNopLogger()
+	client := NewPromtailClient(&promtailClientConfig{
+		backoff:      &backoff.Config{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 1},
+		http:         &httpClientConfig{timeout: time.Second},
+		destinations: destinations,
+	}, &logger)
+
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "request-1"})
+	b := &batch{streams: map[string]*logproto.Stream{
+		`{app="a"}`: {Labels: `{app="a"}`, Entries: []logproto.Entry{{Timestamp: time.Now(), Line: "hello"}}},
+	}}
+	require.NoError(t, client.sendToPromtail(ctx, b))
+
+	require.Equal(t, "key", headers.Get("X-Api-Key"))
+	require.Equal(t, "lambda-promtail/request-1", headers.Get("X-Invocation"))
+	require.Equal(t, "gateway-team", headers.Get("X-Route"))
+	require.Equal(t, "team", headers.Get("X-Scope-OrgID"))
+}
+
+func Test_promtailClient_headersPerStream(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests = map[string]int{}
+	)
+	loki := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		req := decodePushRequest(t, r.Header.Get("Content-Type"), r.Header.Get("Content-Encoding"), body)
+		mu.Lock()
+		defer mu.Unlock()
+		// X-Team is the team of every stream of the request.
+		for _, stream := range req.Streams {
+			if team := r.Header.Get("X-Team"); team != "" {
+				require.Contains(t, stream.Labels, `team="`+team+`"`)
+			} else {
+				require.NotContains(t, stream.Labels, "team=")
+			}
+		}
+		requests[r.Header.Get("X-Team")+"/"+r.Header.Get("X-Route")] += len(req.Streams)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer loki.Close()
+
+	destinations, err := parseDestinations(context.Background(), &testSecretsClient{}, `[{
+		"name": "gateway",
+		"write_address": "`+loki.URL+`",
+		"headers": {
+			"X-Route": "{{ .Destination }}",
+			"X-Team": "{{ .Labels.team }}"
+		}
+	}]`)
+	require.NoError(t, err)
+	logger := log.NewNopLogger()
+	client := NewPromtailClient(&promtailClientConfig{
+		backoff:      &backoff.Config{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 1},
+		http:         &httpClientConfig{timeout: time.Second},
+		destinations: destinations,
+	}, &logger)
+
+	entries := []logproto.Entry{{Timestamp: time.Now(), Line: "hello"}}
+	b := &batch{streams: map[string]*logproto.Stream{
+		`{app="a", team="payments"}`: {Labels: `{app="a", team="payments"}`, Entries: entries},
+		`{app="b", team="payments"}`: {Labels: `{app="b", team="payments"}`, Entries: entries},
+		`{app="c", team="search"}`:   {Labels: `{app="c", team="search"}`, Entries: entries},
+		`{app="d"}`:                  {Labels: `{app="d"}`, Entries: entries},
+	}}
+	require.NoError(t, client.sendToPromtail(context.Background(), b))
+
+	// One request per team, streams without the label get an empty value.
+	require.Equal(t, map[string]int{"payments/gateway": 2, "search/gateway": 1, "/gateway": 1}, requests)
+}
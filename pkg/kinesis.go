@@ -1,83 +1,98 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
 	"encoding/json"
-	"io"
-	"log"
+	"fmt"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/prometheus/common/model"
 
+	"github.com/grafana/loki/pkg/push"
 	"github.com/grafana/loki/v3/pkg/logproto"
 )
 
-func parseKinesisEvent(ctx context.Context, b *batch, ev *events.KinesisEvent) error {
+// parseKinesisEvent adds the log events of every record to b. It returns the
+// sequence number of the first record whose log events may not have reached
+// Loki yet, which is where processing has to resume if sending fails.
+func parseKinesisEvent(ctx context.Context, b *batch, ev *events.KinesisEvent) (string, error) {
 	if ev == nil {
-		return nil
+		return "", nil
 	}
 
-	var data []byte
-	var recordData events.CloudwatchLogsData
-	var err error
-
+	var pending string
 	for _, record := range ev.Records {
-		if isGzipped(record.Kinesis.Data) {
-			data, err = ungzipData(record.Kinesis.Data)
-			if err != nil {
-				log.Printf("Error decompressing data: %v", err)
-			}
-		} else {
-			data = record.Kinesis.Data
+		if b.size == 0 {
+			pending = record.Kinesis.SequenceNumber
 		}
 
-		recordData, err = unmarshalData(data)
+		recordData, err := decodeKinesisRecord(record.Kinesis.Data)
 		if err != nil {
-			log.Printf("Error unmarshalling data: %v", err)
+			// Send the log events of the records before the corrupt one, so
+			// that processing can resume from the corrupt record itself.
+			if b.size > 0 {
+				if err := b.flushBatch(ctx); err != nil {
+					return pending, err
+				}
+			}
+			return record.Kinesis.SequenceNumber, fmt.Errorf("failed to decode kinesis record %s: %w", record.Kinesis.SequenceNumber, err)
 		}
 
-		labels := createLabels(record, recordData)
+		labels, metadata := createLabels(record, recordData)
 
-		if err := processLogEvents(ctx, b, recordData.LogEvents, labels); err != nil {
-			return err
+		if err := processLogEvents(ctx, b, recordData.LogEvents, labels, metadata); err != nil {
+			return pending, err
 		}
 	}
 
-	return nil
+	return pending, nil
 }
 
-func processKinesisEvent(ctx context.Context, ev *events.KinesisEvent, pClient Client, processingPipeline *LokiStages) error {
+// processKinesisEvent sends the log events of ev to Loki. When REPORT_BATCH_ITEM_FAILURES
+// is enabled, a failure is reported as the sequence number to resume from instead
+// of failing the whole batch.
+// https://docs.aws.amazon.com/lambda/latest/dg/services-kinesis-batchfailurereporting.html
+func processKinesisEvent(ctx context.Context, ev *events.KinesisEvent, pClient Client, processingPipeline *LokiStages, log *log.Logger) (events.KinesisEventResponse, error) {
+	var resp events.KinesisEventResponse
 	batch, _ := newBatch(ctx, pClient, processingPipeline)
-
-	err := parseKinesisEvent(ctx, batch, ev)
-	if err != nil {
-		return err
+	if reportBatchItemFailures {
+		// The records to resume from are tracked by what was flushed, which
+		// requires each flush to be sent before adding more entries.
+		batch.sender = nil
 	}
 
-	err = pClient.sendToPromtail(ctx, batch)
-	if err != nil {
-		return err
+	pending, err := parseKinesisEvent(ctx, batch, ev)
+	if err == nil {
+		err = batch.flushBatch(ctx)
+	}
+	if err == nil {
+		return resp, nil
+	}
+	if !reportBatchItemFailures || pending == "" {
+		return resp, err
 	}
-	return nil
-}
 
-// isGzipped checks if the input data is gzipped
-func isGzipped(data []byte) bool {
-	return len(data) >= 2 && data[0] == 0x1F && data[1] == 0x8B
+	level.Error(*log).Log("msg", fmt.Sprintf("failed to process kinesis records, resuming from %s", pending), "err", err) // nolint:errcheck
+	resp.BatchItemFailures = []events.KinesisBatchItemFailure{{ItemIdentifier: pending}}
+	return resp, nil
 }
 
-// ungzipData decompress the gzipped data
-func ungzipData(data []byte) ([]byte, error) {
-	reader, err := gzip.NewReader(bytes.NewBuffer(data))
+// decodeKinesisRecord decompresses the record data if needed and unmarshals the
+// CloudWatch Logs subscription payload it contains.
+func decodeKinesisRecord(data []byte) (events.CloudwatchLogsData, error) {
+	data, err := decompressData(data)
 	if err != nil {
-		return nil, err
+		return events.CloudwatchLogsData{}, fmt.Errorf("error decompressing data: %w", err)
 	}
-	defer reader.Close()
 
-	return io.ReadAll(reader)
+	recordData, err := unmarshalData(data)
+	if err != nil {
+		return events.CloudwatchLogsData{}, fmt.Errorf("error unmarshalling data: %w", err)
+	}
+	return recordData, nil
 }
 
 func unmarshalData(data []byte) (events.CloudwatchLogsData, error) {
@@ -86,7 +101,7 @@ func unmarshalData(data []byte) (events.CloudwatchLogsData, error) {
 	return recordData, err
 }
 
-func createLabels(record events.KinesisEventRecord, recordData events.CloudwatchLogsData) model.LabelSet {
+func createLabels(record events.KinesisEventRecord, recordData events.CloudwatchLogsData) (model.LabelSet, push.LabelsAdapter) {
 	labels := model.LabelSet{
 		model.LabelName("__aws_log_type"):                 model.LabelValue("kinesis"),
 		model.LabelName("__aws_kinesis_event_source_arn"): model.LabelValue(record.EventSourceArn),
@@ -98,16 +113,23 @@ func createLabels(record events.KinesisEventRecord, recordData events.Cloudwatch
 		labels[model.LabelName("__aws_cloudwatch_log_stream")] = model.LabelValue(recordData.LogStream)
 	}
 
-	return applyLabels(labels)
+	metadata := structuredMetadata(labels, model.LabelSet{
+		model.LabelName("__aws_cloudwatch_log_stream"):   model.LabelValue(recordData.LogStream),
+		model.LabelName("__aws_kinesis_sequence_number"): model.LabelValue(record.Kinesis.SequenceNumber),
+		model.LabelName("__aws_kinesis_partition_key"):   model.LabelValue(record.Kinesis.PartitionKey),
+	})
+
+	return applyLabels(labels), metadata
 }
 
-func processLogEvents(ctx context.Context, b *batch, logEvents []events.CloudwatchLogsLogEvent, labels model.LabelSet) error {
+func processLogEvents(ctx context.Context, b *batch, logEvents []events.CloudwatchLogsLogEvent, labels model.LabelSet, metadata push.LabelsAdapter) error {
 	for _, logEvent := range logEvents {
 		timestamp := time.UnixMilli(logEvent.Timestamp)
 
 		if err := b.add(ctx, entry{labels, logproto.Entry{
-			Line:      logEvent.Message,
-			Timestamp: timestamp,
+			Line:               logEvent.Message,
+			Timestamp:          timestamp,
+			StructuredMetadata: metadata,
 		}}); err != nil {
 			return err
 		}
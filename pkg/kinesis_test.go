@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"os"
 	"testing"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/go-kit/log"
 	"github.com/stretchr/testify/require"
 
 	"github.com/grafana/loki/v3/pkg/logproto"
@@ -38,6 +42,95 @@ func TestLambdaPromtail_KinesisParseEvents(t *testing.T) {
 
 	ctx := context.TODO()
 
-	err = parseKinesisEvent(ctx, mockBatch, &testEvent)
+	_, err = parseKinesisEvent(ctx, mockBatch, &testEvent)
 	require.Nil(t, err)
 }
+
+type failingPromtailClient struct {
+	sent int
+	err  error
+}
+
+func (c *failingPromtailClient) sendToPromtail(_ context.Context, b *batch) error {
+	if c.err != nil {
+		return c.err
+	}
+	_, entries := b.createPushRequest()
+	c.sent += entries
+	return nil
+}
+
+func kinesisRecord(t *testing.T, sequenceNumber string, data []byte) events.KinesisEventRecord {
+	t.Helper()
+	return events.KinesisEventRecord{
+		EventSourceArn: "arn:aws:kinesis:us-east-1:123456789012:stream/test",
+		Kinesis: events.KinesisRecord{
+			SequenceNumber: sequenceNumber,
+			Data:           data,
+		},
+	}
+}
+
+func gzipCloudwatchLogsData(t *testing.T, messages ...string) []byte {
+	t.Helper()
+	data := events.CloudwatchLogsData{LogGroup: "test-group", Owner: "123456789012"}
+	for _, m := range messages {
+		data.LogEvents = append(data.LogEvents, events.CloudwatchLogsLogEvent{Timestamp: 1719922604969, Message: m})
+	}
+	raw, err := json.Marshal(data)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err = w.Write(raw)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestLambdaPromtail_KinesisBatchItemFailures(t *testing.T) {
+	batchSize = 131072 // Set large enough we only send once
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	logger := log.NewNopLogger()
+
+	reportBatchItemFailures = true
+	defer func() { reportBatchItemFailures = false }()
+
+	t.Run("corrupt record", func(t *testing.T) {
+		client := &failingPromtailClient{}
+		ev := &events.KinesisEvent{Records: []events.KinesisEventRecord{
+			kinesisRecord(t, "1", gzipCloudwatchLogsData(t, "a", "b")),
+			kinesisRecord(t, "2", []byte("not json")),
+			kinesisRecord(t, "3", gzipCloudwatchLogsData(t, "c")),
+		}}
+
+		resp, err := processKinesisEvent(context.Background(), ev, client, process, &logger)
+		require.NoError(t, err)
+		require.Equal(t, []events.KinesisBatchItemFailure{{ItemIdentifier: "2"}}, resp.BatchItemFailures)
+		// The records before the corrupt one are sent before reporting it.
+		require.Equal(t, 2, client.sent)
+	})
+
+	t.Run("send failure", func(t *testing.T) {
+		client := &failingPromtailClient{err: errors.New("server returned HTTP status 400")}
+		ev := &events.KinesisEvent{Records: []events.KinesisEventRecord{
+			kinesisRecord(t, "1", gzipCloudwatchLogsData(t, "a")),
+			kinesisRecord(t, "2", gzipCloudwatchLogsData(t, "b")),
+		}}
+
+		resp, err := processKinesisEvent(context.Background(), ev, client, process, &logger)
+		require.NoError(t, err)
+		require.Equal(t, []events.KinesisBatchItemFailure{{ItemIdentifier: "1"}}, resp.BatchItemFailures)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		reportBatchItemFailures = false
+		client := &failingPromtailClient{}
+		ev := &events.KinesisEvent{Records: []events.KinesisEventRecord{
+			kinesisRecord(t, "1", []byte("not json")),
+		}}
+
+		_, err := processKinesisEvent(context.Background(), ev, client, process, &logger)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+var (
+	// albLogFields are the fields of an Application Load Balancer access log entry, in order.
+	// source: https://docs.aws.amazon.com/elasticloadbalancing/latest/application/load-balancer-access-logs.html#access-log-entry-syntax
+	albLogFields = []string{
+		"type", "time", "elb", "client:port", "target:port",
+		"request_processing_time", "target_processing_time", "response_processing_time",
+		"elb_status_code", "target_status_code", "received_bytes", "sent_bytes",
+		"request", "user_agent", "ssl_cipher", "ssl_protocol", "target_group_arn",
+		"trace_id", "domain_name", "chosen_cert_arn", "matched_rule_priority",
+		"request_creation_time", "actions_executed", "redirect_url", "error_reason",
+		"target_port_list", "target_status_code_list", "classification", "classification_reason",
+		"conn_trace_id", "transformed_host", "transformed_uri", "request_transform_status",
+	}
+	// nlbLogFields are the fields of a Network Load Balancer access log entry, in order.
+	// source: https://docs.aws.amazon.com/elasticloadbalancing/latest/network/load-balancer-access-logs.html#access-log-entry-format
+	nlbLogFields = []string{
+		"type", "version", "time", "elb", "listener", "client:port", "destination:port",
+		"connection_time", "tls_handshake_time", "received_bytes", "sent_bytes",
+		"incoming_tls_alert", "chosen_cert_arn", "chosen_cert_serial", "tls_cipher",
+		"tls_protocol_version", "tls_named_group", "domain_name", "alpn_fe_protocol",
+		"alpn_be_protocol", "alpn_client_preference_list", "tls_connection_creation_time",
+	}
+)
+
+// parseLbLogFields returns the fields of an ALB or NLB access log line, keyed
+// by the names from the AWS documentation. Fields logged as "-" are omitted.
+// AWS appends new fields to the end of the format over time, fields past the
+// ones known here are named field_<n>, n being their 1-based position.
+func parseLbLogFields(labels map[string]string, line string) map[string]string {
+	names := albLogFields
+	if labels["lb_type"] == LbNlbType {
+		names = nlbLogFields
+	}
+
+	values := splitLbLogLine(line)
+	fields := make(map[string]string, len(values))
+	for i, value := range values {
+		if value == "-" || value == "" {
+			continue
+		}
+
+		name := "field_" + strconv.Itoa(i+1)
+		if i < len(names) {
+			name = names[i]
+		}
+		switch name {
+		case "client:port", "target:port", "destination:port":
+			prefix := strings.TrimSuffix(name, ":port")
+			if idx := strings.LastIndex(value, ":"); idx >= 0 {
+				fields[prefix+"_ip"] = value[:idx]
+				fields[prefix+"_port"] = value[idx+1:]
+			} else {
+				fields[prefix+"_ip"] = value
+			}
+		case "request":
+			// "GET http://www.example.com:80/ HTTP/1.1"
+			parts := strings.SplitN(value, " ", 3)
+			if len(parts) == 3 {
+				fields["request_method"] = parts[0]
+				fields["request_url"] = parts[1]
+				fields["request_protocol"] = parts[2]
+			} else {
+				fields[name] = value
+			}
+		default:
+			fields[name] = value
+		}
+	}
+	return fields
+}
+
+// splitLbLogLine splits a load balancer access log line on spaces, keeping
+// double quoted values together and stripping the quotes.
+func splitLbLogLine(line string) []string {
+	var (
+		values  []string
+		value   strings.Builder
+		quoted  bool
+		started bool
+	)
+	for _, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			started = true
+		case r == ' ' && !quoted:
+			if started {
+				values = append(values, value.String())
+				value.Reset()
+				started = false
+			}
+		default:
+			value.WriteRune(r)
+			started = true
+		}
+	}
+	if started {
+		values = append(values, value.String())
+	}
+	return values
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/push"
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+func Test_parseLbLogFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		line   string
+		want   map[string]string
+	}{
+		{
+			name:   "alb",
+			labels: map[string]string{"lb_type": LbAlbType},
+			line:   `https 2022-12-06T17:42:19.086095Z random/lb/f12345d67890 12.34.178.90.32:39054 10.0.0.1:80 0.001 0.002 0.000 404 404 243 176 "GET https://5.334.234.101:443/ HTTP/1.1" "curl/8.0" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 - "Root=1-638f7efb-70296a81055f363c18df33b6" "5.334.234.101:443" "-" 0 2022-12-06T17:42:19.085000Z "forward" "-" "-" "10.0.0.1:80" "404" "-" "-" TID_1 "-" "-" "-" "new" "field"`,
+			want: map[string]string{
+				"type":                     "https",
+				"time":                     "2022-12-06T17:42:19.086095Z",
+				"elb":                      "random/lb/f12345d67890",
+				"client_ip":                "12.34.178.90.32",
+				"client_port":              "39054",
+				"target_ip":                "10.0.0.1",
+				"target_port":              "80",
+				"request_processing_time":  "0.001",
+				"target_processing_time":   "0.002",
+				"response_processing_time": "0.000",
+				"elb_status_code":          "404",
+				"target_status_code":       "404",
+				"received_bytes":           "243",
+				"sent_bytes":               "176",
+				"request_method":           "GET",
+				"request_url":              "https://5.334.234.101:443/",
+				"request_protocol":         "HTTP/1.1",
+				"user_agent":               "curl/8.0",
+				"ssl_cipher":               "ECDHE-RSA-AES128-GCM-SHA256",
+				"ssl_protocol":             "TLSv1.2",
+				"trace_id":                 "Root=1-638f7efb-70296a81055f363c18df33b6",
+				"domain_name":              "5.334.234.101:443",
+				"matched_rule_priority":    "0",
+				"request_creation_time":    "2022-12-06T17:42:19.085000Z",
+				"actions_executed":         "forward",
+				"target_port_list":         "10.0.0.1:80",
+				"target_status_code_list":  "404",
+				"conn_trace_id":            "TID_1",
+				"field_34":                 "new",
+				"field_35":                 "field",
+			},
+		},
+		{
+			name:   "nlb",
+			labels: map[string]string{"lb_type": LbNlbType},
+			line:   `tls 2.0 2020-04-01T08:51:42 net/my-network-loadbalancer/c6e77e28c25b2234 g3d4b5e8bb8464cd 72.21.218.154:51341 172.100.100.185:443 5 2 98 246 - arn:aws:acm:us-east-2:671290407336:certificate/2a108f19-aded-46b0-8493-c63eb1ef4a99 - ECDHE-RSA-AES128-SHA tlsv12 - my-network-loadbalancer-c6e77e28c25b2234.elb.us-east-2.amazonaws.com h2 h2 "h2","http/1.1" 2020-04-01T08:51:20 - "extra field"`,
+			want: map[string]string{
+				"type":                         "tls",
+				"version":                      "2.0",
+				"time":                         "2020-04-01T08:51:42",
+				"elb":                          "net/my-network-loadbalancer/c6e77e28c25b2234",
+				"listener":                     "g3d4b5e8bb8464cd",
+				"client_ip":                    "72.21.218.154",
+				"client_port":                  "51341",
+				"destination_ip":               "172.100.100.185",
+				"destination_port":             "443",
+				"connection_time":              "5",
+				"tls_handshake_time":           "2",
+				"received_bytes":               "98",
+				"sent_bytes":                   "246",
+				"chosen_cert_arn":              "arn:aws:acm:us-east-2:671290407336:certificate/2a108f19-aded-46b0-8493-c63eb1ef4a99",
+				"tls_cipher":                   "ECDHE-RSA-AES128-SHA",
+				"tls_protocol_version":         "tlsv12",
+				"domain_name":                  "my-network-loadbalancer-c6e77e28c25b2234.elb.us-east-2.amazonaws.com",
+				"alpn_fe_protocol":             "h2",
+				"alpn_be_protocol":             "h2",
+				"alpn_client_preference_list":  "h2,http/1.1",
+				"tls_connection_creation_time": "2020-04-01T08:51:20",
+				"field_24":                     "extra field",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, parseLbLogFields(tt.labels, tt.line))
+		})
+	}
+}
+
+func Test_parseS3Log_lbStructuredMetadata(t *testing.T) {
+	batchSize = 131072 // Set large enough we don't try and send to promtail
+	structuredMetadataLabels = []model.LabelName{"__aws_s3_lb_elb_status_code", "__aws_s3_lb_request_url"}
+	defer func() { structuredMetadataLabels = nil }()
+
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	b := &batch{
+		streams:   map[string]*logproto.Stream{},
+		processor: process,
+	}
+	obj, err := os.Open("../testdata/albaccesslog.log.gz")
+	require.NoError(t, err)
+	defer obj.Close()
+
+	logger := log.NewLogfmtLogger(&bytes.Buffer{})
+	labels := map[string]string{
+		"type":       LbLogType,
+		"lb_type":    LbAlbType,
+		"src":        "source",
+		"account_id": "123456789",
+	}
+	require.NoError(t, parseS3Log(context.Background(), b, labels, obj, &logger))
+
+	stream, ok := b.streams[`{__aws_log_type="s3_lb", __aws_s3_lb="source", __aws_s3_lb_owner="123456789"}`]
+	require.True(t, ok)
+	require.Len(t, stream.Entries, 2)
+	require.Equal(t, push.LabelsAdapter{
+		{Name: "aws_s3_lb_elb_status_code", Value: "301"},
+		{Name: "aws_s3_lb_request_url", Value: "http://5.334.234.101:80/"},
+	}, stream.Entries[0].StructuredMetadata)
+	require.Equal(t, push.LabelsAdapter{
+		{Name: "aws_s3_lb_elb_status_code", Value: "404"},
+		{Name: "aws_s3_lb_request_url", Value: "https://5.334.234.101:443/"},
+	}, stream.Entries[1].StructuredMetadata)
+}
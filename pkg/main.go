@@ -2,16 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/grafana/dskit/backoff"
+	"github.com/grafana/loki/pkg/push"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 	prommodel "github.com/prometheus/prometheus/model/labels"
@@ -23,41 +27,68 @@ import (
 )
 
 const (
-	// We use snappy-encoded protobufs over http by default.
-	contentType = "application/x-protobuf"
-
 	maxErrMsgLen = 1024
 
+	defaultSecretCacheTTL = 5 * time.Minute
+	// enough for the errors Loki returns about single entries
+	maxErrBodyLen = 64 << 10
+
 	invalidExtraLabelsError = "invalid value for environment variable EXTRA_LABELS. Expected a comma separated list with an even number of entries. "
 )
 
 var (
-	writeAddress                                                             *url.URL
-	username, password, extraLabelsRaw, dropLabelsRaw, tenantID, bearerToken string
-	keepStream                                                               bool
-	batchSize                                                                int
-	pipelineTimeout                                                          time.Duration
-	s3Clients                                                                map[string]*s3.Client
-	extraLabels                                                              model.LabelSet
-	dropLabels                                                               []model.LabelName
-	skipTLSVerify                                                            bool
-	printLogLine                                                             bool
-	relabelConfigs                                                           []*relabel.Config
+	writeAddress                              *url.URL
+	extraLabelsRaw, dropLabelsRaw, tenantID   string
+	username, password, bearerToken           *secretValue
+	secretCacheTTL                            time.Duration
+	keepStream                                bool
+	batchSize                                 int
+	maxInFlight                               int
+	s3Concurrency                             int
+	pipelineTimeout                           time.Duration
+	s3Clients                                 map[string]*s3.Client
+	extraLabels                               model.LabelSet
+	dropLabels                                []model.LabelName
+	structuredMetadataLabels                  []model.LabelName
+	skipTLSVerify                             bool
+	tlsConfig                                 *tls.Config
+	printLogLine                              bool
+	reportBatchItemFailures                   bool
+	destinations                              []*destination
+	checkpoints                               checkpointStore
+	deadLetters                               deadLetterSink
+	rejectedEntries                           string
+	sigv4                                     *sigv4Signer
+	oauth2                                    *oauth2TokenSource
+	pushHeaders                               []*pushHeader
+	pushFormat                                string
+	relabelConfigs                            []*relabel.Config
+	parquetLineFormat, parquetTimestampColumn string
+	parquetMaxObjectSize                      int64
 )
 
 func setupArguments(ctx context.Context, secretFetcher secretFetcher) {
-	addr := os.Getenv("WRITE_ADDRESS")
-	if addr == "" {
-		panic(errors.New("required environmental variable WRITE_ADDRESS not present, format: https://<hostname>/loki/api/v1/push"))
+	destinationsRaw, err := loadConfigEnv(ctx, secretFetcher, "DESTINATIONS")
+	if err != nil {
+		panic(err)
 	}
-
-	var err error
-	writeAddress, err = url.Parse(addr)
+	destinations, err = parseDestinations(ctx, secretFetcher, destinationsRaw)
 	if err != nil {
 		panic(err)
 	}
 
-	fmt.Println("write address: ", writeAddress.String())
+	addr := os.Getenv("WRITE_ADDRESS")
+	if addr == "" && len(destinations) == 0 {
+		panic(errors.New("required environmental variable WRITE_ADDRESS not present, format: https://<hostname>/loki/api/v1/push"))
+	}
+
+	if addr != "" {
+		writeAddress, err = url.Parse(addr)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println("write address: ", writeAddress.String())
+	}
 
 	omitExtraLabelsPrefix := os.Getenv("OMIT_EXTRA_LABELS_PREFIX")
 	extraLabelsRaw = os.Getenv("EXTRA_LABELS")
@@ -71,36 +102,126 @@ func setupArguments(ctx context.Context, secretFetcher secretFetcher) {
 		panic(err)
 	}
 
-	username, err = loadSensitiveEnv(ctx, secretFetcher, "USERNAME")
+	structuredMetadataLabels, err = getStructuredMetadataLabels()
 	if err != nil {
 		panic(err)
 	}
-	password, err = loadSensitiveEnv(ctx, secretFetcher, "PASSWORD")
+
+	secretCacheTTL = defaultSecretCacheTTL
+	if ttl := os.Getenv("SECRET_CACHE_TTL"); ttl != "" {
+		secretCacheTTL, err = time.ParseDuration(ttl)
+		if err != nil || secretCacheTTL < 0 {
+			panic(fmt.Errorf("invalid value for environment variable SECRET_CACHE_TTL: %q, expected a duration like 5m, or 0 to only fetch rejected secrets again", ttl))
+		}
+	}
+
+	username, err = loadSecretEnv(ctx, secretFetcher, "USERNAME")
+	if err != nil {
+		panic(err)
+	}
+	password, err = loadSecretEnv(ctx, secretFetcher, "PASSWORD")
 	if err != nil {
 		panic(err)
 	}
 	// If either username or password is set then both must be.
-	if (username != "" && password == "") || (username == "" && password != "") {
+	if (username != nil && password == nil) || (username == nil && password != nil) {
 		panic("both username and password must be set if either one is set")
 	}
 
-	bearerToken, err = loadSensitiveEnv(ctx, secretFetcher, "BEARER_TOKEN")
+	bearerToken, err = loadSecretEnv(ctx, secretFetcher, "BEARER_TOKEN")
 	if err != nil {
 		panic(err)
 	}
 	// If username and password are set, bearer token is not allowed
-	if username != "" && bearerToken != "" {
+	if username != nil && bearerToken != nil {
 		panic("both username and bearerToken are not allowed")
 	}
 
+	// SigV4 signs the requests to WRITE_ADDRESS with the credentials of the
+	// Lambda execution role.
+	if service := os.Getenv("SIGV4_SERVICE"); service != "" && writeAddress != nil {
+		if username != nil || bearerToken != nil {
+			panic("SIGV4_SERVICE is not allowed with USERNAME or BEARER_TOKEN")
+		}
+		sigv4, err = newSigV4Signer(ctx, service, os.Getenv("SIGV4_REGION"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// OAuth2 fetches short-lived bearer tokens for the requests to WRITE_ADDRESS.
+	if tokenURL := os.Getenv("OAUTH2_TOKEN_URL"); tokenURL != "" && writeAddress != nil {
+		if username != nil || bearerToken != nil || sigv4 != nil {
+			panic("OAUTH2_TOKEN_URL is not allowed with USERNAME, BEARER_TOKEN or SIGV4_SERVICE")
+		}
+		clientSecret, err := loadSecretEnv(ctx, secretFetcher, "OAUTH2_CLIENT_SECRET")
+		if err != nil {
+			panic(err)
+		}
+		var scopes []string
+		if raw := os.Getenv("OAUTH2_SCOPES"); raw != "" {
+			scopes = strings.Split(raw, ",")
+		}
+		oauth2, err = newOAuth2TokenSource(tokenURL, os.Getenv("OAUTH2_CLIENT_ID"), clientSecret, scopes)
+		if err != nil {
+			panic(fmt.Errorf("invalid OAuth2 configuration: %w", err))
+		}
+	}
+
 	skipTLS := os.Getenv("SKIP_TLS_VERIFY")
 	// Anything other than case-insensitive 'true' is treated as 'false'.
 	if strings.EqualFold(skipTLS, "true") {
 		skipTLSVerify = true
 	}
 
+	caCert, err := loadSensitiveEnv(ctx, secretFetcher, "TLS_CA_CERT")
+	if err != nil {
+		panic(err)
+	}
+	clientCert, err := loadSensitiveEnv(ctx, secretFetcher, "TLS_CLIENT_CERT")
+	if err != nil {
+		panic(err)
+	}
+	clientKey, err := loadSensitiveEnv(ctx, secretFetcher, "TLS_CLIENT_KEY")
+	if err != nil {
+		panic(err)
+	}
+	tlsConfig, err = newTLSConfig(caCert, clientCert, clientKey)
+	if err != nil {
+		panic(fmt.Errorf("invalid TLS configuration: %w", err))
+	}
+
 	tenantID = os.Getenv("TENANT_ID")
 
+	headersRaw, err := loadConfigEnv(ctx, secretFetcher, "HEADERS")
+	if err != nil {
+		panic(err)
+	}
+	pushHeaders, err = parseHeadersJSON(ctx, secretFetcher, headersRaw)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, d := range destinations {
+		fmt.Println("destination: ", d.name, d.writeAddress.String())
+	}
+
+	// WRITE_ADDRESS is the destination of every stream, next to the ones in DESTINATIONS.
+	if writeAddress != nil {
+		destinations = append([]*destination{{
+			name:         defaultDestinationName,
+			writeAddress: writeAddress,
+			tenantID:     tenantID,
+			username:     username,
+			password:     password,
+			bearerToken:  bearerToken,
+			sigv4:        sigv4,
+			oauth2:       oauth2,
+			headers:      pushHeaders,
+			tls:          tlsConfig,
+		}}, destinations...)
+	}
+
 	keep := os.Getenv("KEEP_STREAM")
 	// Anything other than case-insensitive 'true' is treated as 'false'.
 	if strings.EqualFold(keep, "true") {
@@ -114,6 +235,22 @@ func setupArguments(ctx context.Context, secretFetcher secretFetcher) {
 		batchSize, _ = strconv.Atoi(batch)
 	}
 
+	maxInFlight = 1
+	if inFlight := os.Getenv("MAX_IN_FLIGHT"); inFlight != "" {
+		maxInFlight, err = strconv.Atoi(inFlight)
+		if err != nil || maxInFlight < 1 {
+			panic(fmt.Errorf("invalid value for environment variable MAX_IN_FLIGHT: %q, expected a positive integer", inFlight))
+		}
+	}
+
+	s3Concurrency = 1
+	if concurrency := os.Getenv("S3_CONCURRENCY"); concurrency != "" {
+		s3Concurrency, err = strconv.Atoi(concurrency)
+		if err != nil || s3Concurrency < 1 {
+			panic(fmt.Errorf("invalid value for environment variable S3_CONCURRENCY: %q, expected a positive integer", concurrency))
+		}
+	}
+
 	pipelineTimeout = defaultPipelineTimeout
 	timeoutStr := os.Getenv("PIPELINE_TIMEOUT")
 	if timeoutStr != "" {
@@ -126,8 +263,74 @@ func setupArguments(ctx context.Context, secretFetcher secretFetcher) {
 	if strings.EqualFold(os.Getenv("PRINT_LOG_LINE"), "false") {
 		printLogLine = false
 	}
+	// Only enable this when the event source mapping has ReportBatchItemFailures
+	// set, otherwise Lambda treats a partial failure response as a full success.
+	if strings.EqualFold(os.Getenv("REPORT_BATCH_ITEM_FAILURES"), "true") {
+		reportBatchItemFailures = true
+	}
+
+	parquetLineFormat = parquetLineFormatLogfmt
+	if format := os.Getenv("PARQUET_LINE_FORMAT"); format != "" {
+		if format != parquetLineFormatLogfmt && format != parquetLineFormatJSON {
+			panic(fmt.Errorf("invalid value for environment variable PARQUET_LINE_FORMAT: %q, expected %q or %q", format, parquetLineFormatLogfmt, parquetLineFormatJSON))
+		}
+		parquetLineFormat = format
+	}
+	parquetTimestampColumn = os.Getenv("PARQUET_TIMESTAMP_COLUMN")
+
+	parquetMaxObjectSize = defaultParquetMaxObjectSize
+	if size := os.Getenv("PARQUET_MAX_OBJECT_SIZE"); size != "" {
+		parquetMaxObjectSize, err = strconv.ParseInt(size, 10, 64)
+		if err != nil || parquetMaxObjectSize < 0 {
+			panic(fmt.Errorf("invalid value for environment variable PARQUET_MAX_OBJECT_SIZE: %q, expected a size in bytes, or 0 for no limit", size))
+		}
+	}
+
+	rejectedEntries = rejectedEntriesDrop
+	if policy := os.Getenv("REJECTED_ENTRIES"); policy != "" {
+		if policy != rejectedEntriesDrop && policy != rejectedEntriesClamp && policy != rejectedEntriesFail {
+			panic(fmt.Errorf("invalid value for environment variable REJECTED_ENTRIES: %q, expected %q, %q or %q", policy, rejectedEntriesDrop, rejectedEntriesClamp, rejectedEntriesFail))
+		}
+		rejectedEntries = policy
+	}
+
+	pushFormat = pushFormatProtobuf
+	if format := os.Getenv("PUSH_FORMAT"); format != "" {
+		if lookupPushEncoder(format) == nil {
+			panic(fmt.Errorf("invalid value for environment variable PUSH_FORMAT: %q, expected %q, %q or %q", format, pushFormatProtobuf, pushFormatJSON, pushFormatJSONGzip))
+		}
+		pushFormat = format
+	}
+
 	s3Clients = make(map[string]*s3.Client)
 
+	if location := os.Getenv("DEAD_LETTER_LOCATION"); location != "" {
+		deadLetters, err = newDeadLetterSink(ctx, location)
+		if err != nil {
+			panic(err)
+		}
+		if err := requireDestinationNames(destinations); err != nil {
+			panic(err)
+		}
+	}
+
+	if location := os.Getenv("S3_CHECKPOINT_LOCATION"); location != "" {
+		checkpoints, err = newS3CheckpointStore(ctx, location)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	customParsersRaw, err := loadConfigEnv(ctx, secretFetcher, "S3_PARSERS")
+	if err != nil {
+		panic(err)
+	}
+	customParsers, err := parseCustomParsers(customParsersRaw)
+	if err != nil {
+		panic(err)
+	}
+	registerParsers(customParsers)
+
 	promConfigs, err := parseRelabelConfigs(os.Getenv("RELABEL_CONFIGS"))
 	if err != nil {
 		panic(err)
@@ -182,6 +385,66 @@ func getDropLabels() ([]model.LabelName, error) {
 	return result, nil
 }
 
+func getStructuredMetadataLabels() ([]model.LabelName, error) {
+	var result []model.LabelName
+
+	if raw := os.Getenv("STRUCTURED_METADATA"); raw != "" {
+		for _, name := range strings.Split(raw, ",") {
+			labelName := model.LabelName(name)
+			if !strings.HasPrefix(name, "__aws_") || !model.LegacyValidation.IsValidLabelName(name) {
+				return []model.LabelName{}, fmt.Errorf("invalid structured metadata field %s, expected an __aws_ label name", name)
+			}
+			result = append(result, labelName)
+		}
+	}
+
+	return result, nil
+}
+
+// structuredMetadata moves the fields listed in STRUCTURED_METADATA out of
+// labels and returns them as structured metadata. extra holds the fields that
+// are too high-cardinality to ever be labels, like the S3 object key, and are
+// only sent when listed. The leading "__" is stripped from the names, since
+// Loki reserves those for internal use.
+func structuredMetadata(labels model.LabelSet, extra model.LabelSet) push.LabelsAdapter {
+	var metadata push.LabelsAdapter
+	for _, name := range structuredMetadataLabels {
+		value, ok := labels[name]
+		if ok {
+			delete(labels, name)
+		} else {
+			value = extra[name]
+		}
+		if value == "" {
+			continue
+		}
+		metadata = append(metadata, push.LabelAdapter{
+			Name:  strings.TrimPrefix(string(name), "__"),
+			Value: string(value),
+		})
+	}
+	// The slice is shared by every entry of the same source, clip it so that
+	// pipeline stages appending to one entry can't overwrite another's.
+	return slices.Clip(metadata)
+}
+
+// fieldsMetadata returns the fields parsed from a log line that are listed in
+// STRUCTURED_METADATA as <prefix><field>.
+func fieldsMetadata(prefix string, fields map[string]string) push.LabelsAdapter {
+	var metadata push.LabelsAdapter
+	for _, name := range structuredMetadataLabels {
+		field, ok := strings.CutPrefix(string(name), prefix)
+		if !ok || fields[field] == "" {
+			continue
+		}
+		metadata = append(metadata, push.LabelAdapter{
+			Name:  strings.TrimPrefix(string(name), "__"),
+			Value: fields[field],
+		})
+	}
+	return metadata
+}
+
 func applyRelabelConfigs(labels model.LabelSet) model.LabelSet {
 	if len(relabelConfigs) == 0 {
 		return labels
@@ -229,7 +492,18 @@ func applyLabels(labels model.LabelSet) model.LabelSet {
 	return finalLabels
 }
 
-func handler(ctx context.Context, ev map[string]interface{}) error {
+// lambdaPromtail holds what is built once per container and shared by warm
+// invocations, so that keep-alive connections to Loki and the compiled pipeline
+// stages outlive a single event.
+type lambdaPromtail struct {
+	log      *log.Logger
+	client   Client
+	pipeline *LokiStages
+}
+
+// newLambdaPromtail builds the logger, the Promtail client and the pipeline
+// stages. It must run after setupArguments.
+func newLambdaPromtail() (*lambdaPromtail, error) {
 	lvl, ok := os.LookupEnv("LOG_LEVEL")
 	if !ok {
 		lvl = "info"
@@ -246,19 +520,36 @@ func handler(ctx context.Context, ev map[string]interface{}) error {
 			timeout:       timeout,
 			skipTLSVerify: skipTLSVerify,
 		},
+		destinations:    destinations,
+		deadLetters:     deadLetters,
+		rejectedEntries: rejectedEntries,
+		pushFormat:      pushFormat,
 	}, log)
 
 	lokiStageConfigs, err := ParsePipelineConfigs(os.Getenv("LOKI_STAGE_CONFIGS"), *log, metrics)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
+	return &lambdaPromtail{
+		log:      log,
+		client:   pClient,
+		pipeline: lokiStageConfigs,
+	}, nil
+}
+
+// handler is the Lambda entry point. The returned response is only non-nil for
+// event sources that support partial batch failure reporting.
+func (lp *lambdaPromtail) handler(ctx context.Context, ev map[string]interface{}) (any, error) {
+	log, pClient, lokiStageConfigs := lp.log, lp.client, lp.pipeline
+
 	event, err := checkEventType(ev)
 	if err != nil {
 		level.Error(*log).Log("err", fmt.Errorf("invalid event: %s", ev)) // nolint:errcheck
-		return err
+		return nil, err
 	}
 
+	var resp any
 	switch evt := event.(type) {
 	case *events.CloudWatchEvent:
 		err = processEventBridgeEvent(ctx, evt, pClient, lokiStageConfigs, log, processS3Event)
@@ -267,23 +558,41 @@ func handler(ctx context.Context, ev map[string]interface{}) error {
 	case *events.CloudwatchLogsEvent:
 		err = processCWEvent(ctx, evt, pClient, lokiStageConfigs)
 	case *events.KinesisEvent:
-		err = processKinesisEvent(ctx, evt, pClient, lokiStageConfigs)
+		resp, err = processKinesisEvent(ctx, evt, pClient, lokiStageConfigs, log)
+	case *events.KinesisFirehoseEvent:
+		resp, err = processFirehoseEvent(ctx, evt, pClient, lokiStageConfigs, log)
 	case *events.SQSEvent:
-		err = processSQSEvent(ctx, evt, handler)
+		resp, err = processSQSEvent(ctx, evt, lp.nestedHandler, log)
 	case *events.SNSEvent:
-		err = processSNSEvent(ctx, evt, handler)
+		err = processSNSEvent(ctx, evt, lp.nestedHandler)
 	// When setting up S3 Notification on a bucket, a test event is first sent, see: https://docs.aws.amazon.com/AmazonS3/latest/userguide/notification-content-structure.html
 	case *events.S3TestEvent:
-		return nil
+		return nil, nil
+	case *replayEvent:
+		resp, err = processReplayEvent(ctx, evt, deadLetters, pClient, log)
 	}
 
 	if err != nil {
 		level.Error(*log).Log("err", fmt.Errorf("error processing event: %v", err)) // nolint:errcheck
 	}
+	return resp, err
+}
+
+// nestedHandler processes an event unwrapped from an SQS or SNS message. Any
+// response of the nested event is dropped, only the outer event reports one.
+func (lp *lambdaPromtail) nestedHandler(ctx context.Context, ev map[string]interface{}) error {
+	_, err := lp.handler(ctx, ev)
 	return err
 }
 
 func main() {
 	setupArguments(context.Background(), &secretClients{})
-	lambda.Start(handler)
+	// Failing here fails the init phase of the container, instead of every
+	// invocation it would serve.
+	lp, err := newLambdaPromtail()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to initialize lambda-promtail:", err)
+		os.Exit(1)
+	}
+	lambda.Start(lp.handler)
 }
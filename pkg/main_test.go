@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"os"
 	"testing"
 
 	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/push"
 )
 
 func TestLambdaPromtail_ExtraLabelsValid(t *testing.T) {
@@ -64,3 +67,46 @@ func TestLambdaPromtail_TestDropLabels(t *testing.T) {
 	require.NotContains(t, modifiedLabels, model.LabelName("A1"))
 	require.Contains(t, modifiedLabels, model.LabelName("B2"))
 }
+
+func TestLambdaPromtail_TestStructuredMetadata(t *testing.T) {
+	defer func() {
+		structuredMetadataLabels = nil
+	}()
+
+	t.Setenv("STRUCTURED_METADATA", "__aws_cloudwatch_log_stream,not_aws")
+	_, err := getStructuredMetadataLabels()
+	require.Error(t, err)
+
+	t.Setenv("STRUCTURED_METADATA", "__aws_cloudwatch_log_stream,__aws_s3_key,__aws_s3_bucket")
+	structuredMetadataLabels, err = getStructuredMetadataLabels()
+	require.Nil(t, err)
+
+	labels := model.LabelSet{
+		model.LabelName("__aws_log_type"):              model.LabelValue("cloudwatch"),
+		model.LabelName("__aws_cloudwatch_log_stream"): model.LabelValue("stream"),
+	}
+	metadata := structuredMetadata(labels, model.LabelSet{
+		model.LabelName("__aws_cloudwatch_log_stream"): model.LabelValue("ignored"),
+		model.LabelName("__aws_s3_key"):                model.LabelValue("key"),
+	})
+	require.Equal(t, push.LabelsAdapter{
+		{Name: "aws_cloudwatch_log_stream", Value: "stream"},
+		{Name: "aws_s3_key", Value: "key"},
+	}, metadata)
+	require.Equal(t, model.LabelSet{model.LabelName("__aws_log_type"): model.LabelValue("cloudwatch")}, labels)
+}
+
+func TestLambdaPromtail_NewLambdaPromtail(t *testing.T) {
+	t.Setenv("LOKI_STAGE_CONFIGS", `[{"unknown": {}}]`)
+	_, err := newLambdaPromtail()
+	require.Error(t, err)
+
+	t.Setenv("LOKI_STAGE_CONFIGS", `[{"labeldrop": ["app"]}]`)
+	lp, err := newLambdaPromtail()
+	require.NoError(t, err)
+	require.Equal(t, 1, lp.pipeline.Size())
+
+	resp, err := lp.handler(context.Background(), map[string]any{"Event": "s3:TestEvent"})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+}
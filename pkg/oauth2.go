@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// how long before it expires a token is fetched again
+const oauth2ExpiryMargin = 30 * time.Second
+
+// oauth2Config is the oauth2 field of a destination of the DESTINATIONS
+// environment variable.
+type oauth2Config struct {
+	TokenURL string `json:"token_url"`
+	ClientID string `json:"client_id"`
+	// a value or an ARN, like the other credentials
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes,omitempty"`
+}
+
+// oauth2TokenSource fetches access tokens with the OAuth2 client credentials
+// grant. The token is fetched on the first request and kept by the
+// destination, so it lasts across the invocations of a container until it
+// expires or Loki rejects it.
+type oauth2TokenSource struct {
+	tokenURL     string
+	clientID     string
+	clientSecret *secretValue
+	scopes       []string
+	// The token endpoint gets its own client: SKIP_TLS_VERIFY and the client
+	// certificate are meant for Loki, not for the endpoint the client secret
+	// is sent to.
+	http *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	// zero when the token server didn't say when the token expires
+	expiry time.Time
+}
+
+func newOAuth2TokenSource(tokenURL, clientID string, clientSecret *secretValue, scopes []string) (*oauth2TokenSource, error) {
+	if tokenURL == "" || clientID == "" || clientSecret == nil {
+		return nil, errors.New("token URL, client ID and client secret are all required")
+	}
+	if _, err := url.Parse(tokenURL); err != nil {
+		return nil, fmt.Errorf("invalid token URL: %w", err)
+	}
+	return &oauth2TokenSource{
+		tokenURL:     tokenURL,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		scopes:       scopes,
+		http:         NewHTTPClient(&httpClientConfig{timeout: timeout}),
+	}, nil
+}
+
+// token returns the cached access token, fetching a new one if there is none
+// or it is about to expire.
+func (s *oauth2TokenSource) token(ctx context.Context, log *log.Logger) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.accessToken != "" && (s.expiry.IsZero() || time.Until(s.expiry) > oauth2ExpiryMargin) {
+		return s.accessToken, nil
+	}
+	accessToken, expiresIn, err := s.fetch(ctx, log)
+	if err != nil {
+		return "", err
+	}
+	s.accessToken = accessToken
+	s.expiry = time.Time{}
+	if expiresIn > 0 {
+		s.expiry = time.Now().Add(expiresIn)
+	}
+	return s.accessToken, nil
+}
+
+// invalidate drops the cached token, for the next request to fetch a new one.
+// The client secret is fetched again too, in case it was rotated.
+func (s *oauth2TokenSource) invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accessToken = ""
+	s.clientSecret.invalidate()
+}
+
+// fetch requests a token, with the client credentials in the Authorization
+// header as RFC 6749 section 2.3.1 requires every server to support.
+func (s *oauth2TokenSource) fetch(ctx context.Context, log *log.Logger) (string, time.Duration, error) {
+	clientSecret, err := s.clientSecret.get(ctx, log)
+	if err != nil {
+		return "", 0, err
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(s.scopes) > 0 {
+		form.Set("scope", strings.Join(s.scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgent)
+	req.SetBasicAuth(url.QueryEscape(s.clientID), url.QueryEscape(clientSecret))
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("error fetching oauth2 token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxErrBodyLen))
+	if err != nil {
+		return "", 0, fmt.Errorf("error fetching oauth2 token: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		line, _, _ := strings.Cut(string(body), "\n")
+		if len(line) > maxErrMsgLen {
+			line = line[:maxErrMsgLen]
+		}
+		return "", 0, fmt.Errorf("error fetching oauth2 token, server returned HTTP status %s: %s", resp.Status, line)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", 0, fmt.Errorf("error parsing oauth2 token: %w", err)
+	}
+	if token.AccessToken == "" {
+		return "", 0, errors.New("error parsing oauth2 token: no access_token in the response")
+	}
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/backoff"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/stretchr/testify/require"
+)
+
+// oauth2Servers is a token server and a Loki accepting the tokens it issued,
+// except the revoked ones.
+type oauth2Servers struct {
+	tokenServer *httptest.Server
+	loki        *httptest.Server
+	expiresIn   int
+	issued      int
+	revoked     map[string]bool
+	pushes      int
+}
+
+func newOAuth2Servers(t *testing.T, expiresIn int) *oauth2Servers {
+	s := &oauth2Servers{expiresIn: expiresIn, revoked: map[string]bool{}}
+	s.tokenServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, ok := r.BasicAuth()
+		require.True(t, ok)
+		// The credentials are form-encoded, as RFC 6749 requires.
+		clientSecret, err := url.QueryUnescape(clientSecret)
+		require.NoError(t, err)
+		require.Equal(t, "client", clientID)
+		require.Equal(t, "s3cr%t", clientSecret)
+		require.NoError(t, r.ParseForm())
+		require.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		require.Equal(t, "logs:write logs:admin", r.PostForm.Get("scope"))
+
+		s.issued++
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]any{
+			"access_token": fmt.Sprintf("token-%d", s.issued),
+			"token_type":   "Bearer",
+			"expires_in":   s.expiresIn,
+		}))
+	}))
+	t.Cleanup(s.tokenServer.Close)
+	s.loki = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.pushes++
+		token := r.Header.Get("Authorization")
+		if token == "" || s.revoked[token] {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(s.loki.Close)
+	return s
+}
+
+func (s *oauth2Servers) client(t *testing.T) Client {
+	t.Helper()
+	tokens, err := newOAuth2TokenSource(s.tokenServer.URL, "client", &secretValue{value: "s3cr%t"}, []string{"logs:write", "logs:admin"})
+	require.NoError(t, err)
+	writeAddress, err := url.Parse(s.loki.URL)
+	require.NoError(t, err)
+	logger := log.NewNopLogger()
+	return NewPromtailClient(&promtailClientConfig{
+		backoff:      &backoff.Config{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 2},
+		http:         &httpClientConfig{timeout: time.Second},
+		destinations: []*destination{{name: "default", writeAddress: writeAddress, oauth2: tokens}},
+	}, &logger)
+}
+
+func oauth2TestBatch() *batch {
+	return &batch{streams: map[string]*logproto.Stream{
+		`{app="a"}`: {Labels: `{app="a"}`, Entries: []logproto.Entry{{Timestamp: time.Now(), Line: "hello"}}},
+	}}
+}
+
+func Test_promtailClient_oauth2(t *testing.T) {
+	t.Run("tokens are cached", func(t *testing.T) {
+		s := newOAuth2Servers(t, 3600)
+		client := s.client(t)
+		for range 3 {
+			require.NoError(t, client.sendToPromtail(context.Background(), oauth2TestBatch()))
+		}
+		require.Equal(t, 1, s.issued)
+		require.Equal(t, 3, s.pushes)
+	})
+
+	t.Run("tokens about to expire are fetched again", func(t *testing.T) {
+		s := newOAuth2Servers(t, 10)
+		client := s.client(t)
+		for range 2 {
+			require.NoError(t, client.sendToPromtail(context.Background(), oauth2TestBatch()))
+		}
+		require.Equal(t, 2, s.issued)
+	})
+
+	t.Run("rejected tokens are fetched again once", func(t *testing.T) {
+		s := newOAuth2Servers(t, 3600)
+		client := s.client(t)
+		require.NoError(t, client.sendToPromtail(context.Background(), oauth2TestBatch()))
+
+		s.revoked["Bearer token-1"] = true
+		require.NoError(t, client.sendToPromtail(context.Background(), oauth2TestBatch()))
+		require.Equal(t, 2, s.issued)
+		require.Equal(t, 3, s.pushes)
+
+		s.revoked["Bearer token-2"] = true
+		s.revoked["Bearer token-3"] = true
+		err := client.sendToPromtail(context.Background(), oauth2TestBatch())
+		require.ErrorContains(t, err, "401")
+		require.Equal(t, 3, s.issued)
+		require.Equal(t, 5, s.pushes)
+	})
+}
+
+func Test_oauth2TokenSource_errors(t *testing.T) {
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+	}))
+	defer tokenServer.Close()
+
+	tokens, err := newOAuth2TokenSource(tokenServer.URL, "client", &secretValue{value: "wrong"}, nil)
+	require.NoError(t, err)
+	logger := log.NewNopLogger()
+	_, err = tokens.token(context.Background(), &logger)
+	require.ErrorContains(t, err, `server returned HTTP status 401 Unauthorized: {"error":"invalid_client"}`)
+
+	_, err = newOAuth2TokenSource(tokenServer.URL, "client", nil, nil)
+	require.ErrorContains(t, err, "are all required")
+}
+
+func Test_oauth2TokenSource_tls(t *testing.T) {
+	// The token endpoint is verified whatever SKIP_TLS_VERIFY says, and isn't
+	// sent the client certificate of Loki.
+	ca := newTestCertificate(t, nil, "internal CA")
+	clientCert := newTestCertificate(t, ca, "lambda-promtail")
+	tlsConfig, err := newTLSConfig(ca.cert, clientCert.cert, clientCert.key)
+	require.NoError(t, err)
+
+	var peerCertificates int
+	tokenServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerCertificates = len(r.TLS.PeerCertificates)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"token"}`))
+	}))
+	tokenServer.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	tokenServer.StartTLS()
+	defer tokenServer.Close()
+
+	tokens, err := newOAuth2TokenSource(tokenServer.URL, "client", &secretValue{value: "secret"}, nil)
+	require.NoError(t, err)
+	writeAddress, err := url.Parse(tokenServer.URL)
+	require.NoError(t, err)
+	logger := log.NewNopLogger()
+	client := NewPromtailClient(&promtailClientConfig{
+		backoff:      &backoff.Config{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 1},
+		http:         &httpClientConfig{timeout: time.Second, skipTLSVerify: true, tls: tlsConfig},
+		destinations: []*destination{{name: "default", writeAddress: writeAddress, oauth2: tokens}},
+	}, &logger)
+	err = client.sendToPromtail(context.Background(), oauth2TestBatch())
+	require.ErrorContains(t, err, "error fetching oauth2 token")
+	require.ErrorContains(t, err, "certificate")
+
+	// With the test server trusted, the token is fetched without a client certificate.
+	tokens.http = tokenServer.Client()
+	token, err := tokens.token(context.Background(), &logger)
+	require.NoError(t, err)
+	require.Equal(t, "token", token)
+	require.Zero(t, peerCertificates)
+}
+
+func Test_parseDestinations_oauth2(t *testing.T) {
+	secrets := &testSecretsClient{ReturnValue: "s3cr%t"}
+	destinations, err := parseDestinations(context.Background(), secrets, `[{"write_address": "https://loki.example.com", "oauth2": {"token_url": "https://auth.example.com/token", "client_id": "client", "client_secret": "arn:aws:secretsmanager:us-east-1:123456789012:secret:loki-oauth2", "scopes": ["logs:write"]}}]`)
+	require.NoError(t, err)
+	require.Equal(t, 1, secrets.CallsFetchFromAWSSecretsManager)
+	require.Equal(t, "s3cr%t", destinations[0].oauth2.clientSecret.value)
+	require.Equal(t, []string{"logs:write"}, destinations[0].oauth2.scopes)
+
+	_, err = parseDestinations(context.Background(), secrets, `[{"write_address": "https://loki.example.com", "bearer_token": "token", "oauth2": {"token_url": "https://auth.example.com/token", "client_id": "client", "client_secret": "secret"}}]`)
+	require.ErrorContains(t, err, "oauth2 is not allowed with username, bearer_token or sigv4")
+}
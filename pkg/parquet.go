@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/go-logfmt/logfmt"
+	"github.com/parquet-go/parquet-go"
+	"github.com/prometheus/common/model"
+
+	"github.com/grafana/loki/pkg/push"
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+const (
+	parquetLineFormatLogfmt = "logfmt"
+	parquetLineFormatJSON   = "json"
+
+	defaultParquetMaxObjectSize = 256 << 20
+)
+
+// parquetMagic are the first bytes of every Apache Parquet file.
+// source: https://parquet.apache.org/docs/file-format/
+var parquetMagic = []byte("PAR1")
+
+// parseParquetLog sends each row of a Parquet object as a log line, rendered as
+// logfmt or JSON depending on PARQUET_LINE_FORMAT. The timestamp is taken from
+// the PARQUET_TIMESTAMP_COLUMN column, or the parser's timestampField.
+func parseParquetLog(ctx context.Context, b *batch, parser parserConfig, ls model.LabelSet, metadata push.LabelsAdapter, r io.Reader) error {
+	// Parquet keeps the file metadata in a footer, so the whole object has to
+	// be read before any row can be decoded. Objects over the limit are
+	// rejected rather than running the function out of memory.
+	if parquetMaxObjectSize > 0 {
+		r = io.LimitReader(r, parquetMaxObjectSize+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if parquetMaxObjectSize > 0 && int64(len(data)) > parquetMaxObjectSize {
+		return fmt.Errorf("parquet object is larger than PARQUET_MAX_OBJECT_SIZE of %d bytes", parquetMaxObjectSize)
+	}
+	file, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("failed to open parquet file: %w", err)
+	}
+
+	columns := make([]string, 0, len(file.Schema().Fields()))
+	for _, field := range file.Schema().Fields() {
+		columns = append(columns, field.Name())
+	}
+
+	timestampColumn := parquetTimestampColumn
+	if timestampColumn == "" {
+		timestampColumn = parser.timestampField
+	}
+	fieldsPrefix, fieldsMetadataEnabled := fieldsMetadataPrefix(parser)
+
+	reader := parquet.NewReader(file)
+	defer reader.Close()
+	for {
+		row := map[string]any{}
+		if err := reader.Read(&row); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read parquet row: %w", err)
+		}
+
+		line, err := formatParquetRow(columns, row)
+		if err != nil {
+			return err
+		}
+		if printLogLine {
+			fmt.Println(line)
+		}
+
+		timestamp, err := parquetTimestamp(row[timestampColumn])
+		if err != nil {
+			return fmt.Errorf("failed to parse timestamp column %s: %w", timestampColumn, err)
+		}
+
+		rowMetadata := metadata
+		if fieldsMetadataEnabled {
+			fields := make(map[string]string, len(row))
+			for name, value := range row {
+				if value != nil {
+					fields[name] = fmt.Sprint(value)
+				}
+			}
+			rowMetadata = append(metadata, fieldsMetadata(fieldsPrefix, fields)...)
+		}
+
+		if err := b.add(ctx, entry{ls, logproto.Entry{
+			Line:               line,
+			Timestamp:          timestamp,
+			StructuredMetadata: rowMetadata,
+		}}); err != nil {
+			return err
+		}
+	}
+}
+
+// formatParquetRow renders a row as a single log line, keeping the column order
+// of the schema for logfmt. Nested values are encoded as JSON.
+func formatParquetRow(columns []string, row map[string]any) (string, error) {
+	if parquetLineFormat == parquetLineFormatJSON {
+		line, err := json.Marshal(row)
+		return string(line), err
+	}
+
+	keyvals := make([]any, 0, len(columns)*2)
+	for _, column := range columns {
+		value := row[column]
+		switch value.(type) {
+		case nil:
+			continue
+		case map[string]any, []any:
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return "", err
+			}
+			value = string(encoded)
+		}
+		keyvals = append(keyvals, column, value)
+	}
+	line, err := logfmt.MarshalKeyvals(keyvals...)
+	return string(line), err
+}
+
+// parquetTimestamp converts the value of a timestamp column. Integers are Unix
+// timestamps in seconds or a finer precision, see getUnixSecNsec. It returns the
+// current time if the column is not set.
+func parquetTimestamp(value any) (time.Time, error) {
+	switch v := value.(type) {
+	case nil:
+		return time.Now(), nil
+	case time.Time:
+		return v.UTC(), nil
+	case int32:
+		return unixTimestamp(strconv.FormatInt(int64(v), 10))
+	case int64:
+		return unixTimestamp(strconv.FormatInt(v, 10))
+	case string:
+		if timestamp, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return timestamp.UTC(), nil
+		}
+		return unixTimestamp(v)
+	}
+	return time.Time{}, fmt.Errorf("unsupported timestamp type %T", value)
+}
+
+func unixTimestamp(s string) (time.Time, error) {
+	sec, nsec, err := getUnixSecNsec(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, nsec).UTC(), nil
+}
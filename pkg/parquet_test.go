@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/parquet-go/parquet-go"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/push"
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+type flowLogRow struct {
+	Version   int32  `parquet:"version"`
+	AccountID string `parquet:"account_id"`
+	Srcaddr   string `parquet:"srcaddr"`
+	Start     int64  `parquet:"start"`
+	Action    string `parquet:"action"`
+}
+
+func flowLogParquet(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	require.NoError(t, parquet.Write(&buf, []flowLogRow{
+		{Version: 2, AccountID: "123456789012", Srcaddr: "10.0.0.1", Start: 1669842701, Action: "ACCEPT"},
+		{Version: 2, AccountID: "123456789012", Srcaddr: "10.0.0.2", Start: 1669842715, Action: "REJECT"},
+	}))
+	return buf.Bytes()
+}
+
+func Test_parseS3Log_parquet(t *testing.T) {
+	batchSize = 131072 // Set large enough we don't try and send to promtail
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	logger := log.NewNopLogger()
+	labels := map[string]string{
+		"type":       FlowLogType,
+		"src":        "source",
+		"account_id": "123456789012",
+		"key":        "AWSLogs/123456789012/vpcflowlogs/us-east-1/2022/11/30/123456789012_vpcflowlogs_us-east-1_fl-1234abcd_20221130T2110Z_fe123456.log.parquet",
+	}
+	expectedStream := `{__aws_log_type="s3_vpc_flow", __aws_s3_vpc_flow="source", __aws_s3_vpc_flow_owner="123456789012"}`
+
+	tests := []struct {
+		name          string
+		format        string
+		expectedLines []string
+	}{
+		{
+			name:   "logfmt",
+			format: parquetLineFormatLogfmt,
+			expectedLines: []string{
+				"version=2 account_id=123456789012 srcaddr=10.0.0.1 start=1669842701 action=ACCEPT",
+				"version=2 account_id=123456789012 srcaddr=10.0.0.2 start=1669842715 action=REJECT",
+			},
+		},
+		{
+			name:   "json",
+			format: parquetLineFormatJSON,
+			expectedLines: []string{
+				`{"account_id":"123456789012","action":"ACCEPT","srcaddr":"10.0.0.1","start":1669842701,"version":2}`,
+				`{"account_id":"123456789012","action":"REJECT","srcaddr":"10.0.0.2","start":1669842715,"version":2}`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parquetLineFormat = tt.format
+			structuredMetadataLabels = []model.LabelName{"__aws_s3_vpc_flow_action"}
+			defer func() {
+				parquetLineFormat = parquetLineFormatLogfmt
+				structuredMetadataLabels = nil
+			}()
+
+			b := &batch{
+				streams:   map[string]*logproto.Stream{},
+				processor: process,
+			}
+			obj := io.NopCloser(bytes.NewReader(flowLogParquet(t)))
+			require.NoError(t, parseS3Log(context.Background(), b, labels, obj, &logger))
+
+			stream, ok := b.streams[expectedStream]
+			require.True(t, ok, "batch does not contain stream: %s", expectedStream)
+			require.Len(t, stream.Entries, 2)
+			for i, line := range tt.expectedLines {
+				require.Equal(t, line, stream.Entries[i].Line)
+			}
+			require.Equal(t, time.Date(2022, time.November, 30, 21, 11, 41, 0, time.UTC), stream.Entries[0].Timestamp)
+			require.Equal(t, push.LabelsAdapter{{Name: "aws_s3_vpc_flow_action", Value: "ACCEPT"}}, stream.Entries[0].StructuredMetadata)
+		})
+	}
+}
+
+func Test_parseS3Log_parquetMaxObjectSize(t *testing.T) {
+	data := flowLogParquet(t)
+	parquetMaxObjectSize = int64(len(data)) - 1
+	defer func() { parquetMaxObjectSize = 0 }()
+
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	b := &batch{streams: map[string]*logproto.Stream{}, processor: process}
+	logger := log.NewNopLogger()
+	labels := map[string]string{"type": FlowLogType, "key": "flowlogs.parquet"}
+	err := parseS3Log(context.Background(), b, labels, io.NopCloser(bytes.NewReader(data)), &logger)
+	require.ErrorContains(t, err, "parquet object is larger than PARQUET_MAX_OBJECT_SIZE")
+	require.Empty(t, b.streams)
+
+	parquetMaxObjectSize = int64(len(data))
+	require.NoError(t, parseS3Log(context.Background(), b, labels, io.NopCloser(bytes.NewReader(data)), &logger))
+	require.NotEmpty(t, b.streams)
+}
+
+func Test_parquetTimestamp(t *testing.T) {
+	expected := time.Date(2022, time.November, 30, 21, 11, 41, 0, time.UTC)
+	for _, value := range []any{int64(1669842701), int32(1669842701), "1669842701", "2022-11-30T21:11:41Z", expected} {
+		timestamp, err := parquetTimestamp(value)
+		require.NoError(t, err)
+		require.Equal(t, expected, timestamp)
+	}
+
+	_, err := parquetTimestamp(1.5)
+	require.Error(t, err)
+}
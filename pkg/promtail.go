@@ -1,9 +1,9 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,8 +12,6 @@ import (
 	"time"
 
 	"github.com/go-kit/log/level"
-	"github.com/gogo/protobuf/proto"
-	"github.com/golang/snappy"
 	"github.com/grafana/dskit/backoff"
 	"github.com/prometheus/common/model"
 
@@ -39,10 +37,20 @@ type entry struct {
 }
 
 type batch struct {
-	streams   map[string]*logproto.Stream
+	streams map[string]*logproto.Stream
+	// tenant of the streams with a __tenant_id__ label, by stream key
+	tenantIDs map[string]string
 	size      int
+	// number of lines sent by the previous flushes
+	sent      int
 	client    Client
 	processor *LokiStages
+	// sends the flushes in the background when MAX_IN_FLIGHT is above 1, nil
+	// to send each flush before adding more entries
+	sender *batchSender
+	// called on every flush, returns a function saving the progress of the
+	// entries added so far, which is called once they have all been sent
+	saveProgress func() func(ctx context.Context) error
 }
 
 func newBatch(ctx context.Context, pClient Client, processingPipeline *LokiStages, entries ...entry) (*batch, error) {
@@ -51,6 +59,9 @@ func newBatch(ctx context.Context, pClient Client, processingPipeline *LokiStage
 		client:    pClient,
 		processor: processingPipeline,
 	}
+	if pClient != nil && maxInFlight > 1 {
+		b.sender = newBatchSender(pClient, maxInFlight)
+	}
 
 	for _, entry := range entries {
 		if err := b.add(ctx, entry); err != nil {
@@ -62,6 +73,29 @@ func newBatch(ctx context.Context, pClient Client, processingPipeline *LokiStage
 }
 
 func (b *batch) add(ctx context.Context, e entry) error {
+	b.appendEntry(e)
+
+	// Flush what was parsed so far while there is still time, and stop
+	// processing the event.
+	if approachingDeadline(ctx, deadlineFlushMargin) {
+		if err := b.flushBatch(ctx); err != nil {
+			return err
+		}
+		return &deadlineError{sent: b.sent}
+	}
+
+	if b.size > batchSize {
+		if b.sender != nil {
+			return b.sender.send(ctx, b.take(), b.progressSaver())
+		}
+		return b.flushBatch(ctx)
+	}
+
+	return nil
+}
+
+// appendEntry runs the pipeline stages on the entry and adds it to its stream.
+func (b *batch) appendEntry(e entry) {
 	if b.processor.Size() > 0 {
 		// Apply pipeline stages to entry
 		stageEntry := stages.Entry{
@@ -83,27 +117,29 @@ func (b *batch) add(ctx context.Context, e entry) error {
 
 	// Skip entries with no labels or line (filtered out by relabeling or stage processing)
 	if e.labels == nil || e.entry.Line == "" {
-		return nil
+		return
 	}
 
-	labels := labelsMapToString(e.labels, reservedLabelTenantID)
-	stream, ok := b.streams[labels]
+	// Streams of different tenants are kept apart even when they have the same
+	// labels, the key only differs from the labels for entries with a tenant.
+	key := labelsMapToString(e.labels)
+	stream, ok := b.streams[key]
 	if !ok {
-		b.streams[labels] = &logproto.Stream{
-			Labels:  labels,
+		b.streams[key] = &logproto.Stream{
+			Labels:  labelsMapToString(e.labels, reservedLabelTenantID),
 			Entries: []logproto.Entry{},
 		}
-		stream = b.streams[labels]
+		stream = b.streams[key]
+		if tenantID, ok := e.labels[reservedLabelTenantID]; ok {
+			if b.tenantIDs == nil {
+				b.tenantIDs = map[string]string{}
+			}
+			b.tenantIDs[key] = string(tenantID)
+		}
 	}
 
 	stream.Entries = append(stream.Entries, e.entry)
 	b.size += len(e.entry.Line)
-
-	if b.size > batchSize {
-		return b.flushBatch(ctx)
-	}
-
-	return nil
 }
 
 func labelsMapToString(ls model.LabelSet, without ...model.LabelName) string {
@@ -122,14 +158,33 @@ Outer:
 	return fmt.Sprintf("{%s}", strings.Join(lstrs, ", "))
 }
 
-func (b *batch) encode() ([]byte, int, error) {
+// tenantBatches splits the batch by the __tenant_id__ label of its streams.
+// Streams without it are under the empty tenant, which is sent with the tenant
+// of the destination.
+func (b *batch) tenantBatches() map[string]*batch {
+	if len(b.tenantIDs) == 0 {
+		return map[string]*batch{"": b}
+	}
+
+	result := map[string]*batch{}
+	for key, stream := range b.streams {
+		tenantID := b.tenantIDs[key]
+		tb, ok := result[tenantID]
+		if !ok {
+			tb = &batch{streams: map[string]*logproto.Stream{}}
+			result[tenantID] = tb
+		}
+		tb.streams[key] = stream
+	}
+	return result
+}
+
+func (b *batch) encode(enc *pushEncoder) ([]byte, int, error) {
 	req, entriesCount := b.createPushRequest()
-	buf, err := proto.Marshal(req)
+	buf, err := enc.encode(req)
 	if err != nil {
 		return nil, 0, err
 	}
-
-	buf = snappy.Encode(nil, buf)
 	return buf, entriesCount, nil
 }
 
@@ -146,92 +201,351 @@ func (b *batch) createPushRequest() (*logproto.PushRequest, int) {
 	return &req, entriesCount
 }
 
+// flushBatch sends the entries of the batch, and waits for the flushes being
+// sent in the background.
 func (b *batch) flushBatch(ctx context.Context) error {
+	if b.sender != nil {
+		var err error
+		if len(b.streams) > 0 {
+			err = b.sender.send(ctx, b.take(), b.progressSaver())
+		}
+		sent, waitErr := b.sender.wait()
+		b.sent = sent
+		if waitErr != nil {
+			err = waitErr
+		}
+		if err != nil && approachingDeadline(ctx, deadlineFlushMargin) {
+			return &deadlineError{sent: b.sent, err: err}
+		}
+		return err
+	}
+
 	if b.client != nil {
 		err := b.client.sendToPromtail(ctx, b)
 		if err != nil {
+			if approachingDeadline(ctx, deadlineFlushMargin) {
+				return &deadlineError{sent: b.sent, err: err}
+			}
 			return err
 		}
 	}
+	b.sent += b.entriesCount()
 	b.resetBatch()
 
+	if save := b.progressSaver(); save != nil {
+		return save(ctx)
+	}
+
 	return nil
 }
 
+// take moves the entries of the batch to a new batch, for it to be sent in
+// the background.
+func (b *batch) take() *batch {
+	taken := &batch{streams: b.streams, tenantIDs: b.tenantIDs, size: b.size}
+	b.resetBatch()
+	return taken
+}
+
+func (b *batch) progressSaver() func(ctx context.Context) error {
+	if b.saveProgress == nil {
+		return nil
+	}
+	return b.saveProgress()
+}
+
+func (b *batch) entriesCount() int {
+	count := 0
+	for _, stream := range b.streams {
+		count += len(stream.Entries)
+	}
+	return count
+}
+
 func (b *batch) resetBatch() {
 	b.streams = make(map[string]*logproto.Stream)
+	b.tenantIDs = nil
 	b.size = 0
 }
 
+// sendToPromtail fans the batch out to every destination with matching streams.
+// A failing destination doesn't stop the batch from being sent to the others.
 func (c *promtailClient) sendToPromtail(ctx context.Context, b *batch) error {
-	buf, _, err := b.encode()
+	var errs []error
+	for _, d := range c.config.destinations {
+		filtered, err := d.filter(b)
+		if err != nil {
+			return err
+		}
+		if len(filtered.streams) == 0 {
+			continue
+		}
+		for tenantID, tb := range filtered.tenantBatches() {
+			if tenantID == "" {
+				tenantID = d.tenantID
+			}
+			if err := c.sendToDestination(ctx, d, tenantID, tb); err != nil {
+				errs = append(errs, fmt.Errorf("destination %s: %w", d.name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sendToDestination sends a batch to a destination, in one request for each
+// set of values its header templates take for the streams.
+func (c *promtailClient) sendToDestination(ctx context.Context, d *destination, tenantID string, b *batch) error {
+	headerBatches, err := d.headerBatches(ctx, tenantID, b)
 	if err != nil {
 		return err
 	}
+	var errs []error
+	for _, hb := range headerBatches {
+		if err := c.sendHeaderBatch(ctx, d, tenantID, hb.headers, hb.batch); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
 
+// sendHeaderBatch sends a batch to a destination, retrying on failures. A
+// batch that still fails is written to the dead-letter sink, if there is one.
+func (c *promtailClient) sendHeaderBatch(ctx context.Context, d *destination, tenantID string, headers http.Header, b *batch) error {
+	enc := c.encoder()
+	buf, _, err := b.encode(enc)
+	if err != nil {
+		return err
+	}
+
+	status, err := c.sendWithRetries(ctx, d, tenantID, headers, enc, buf)
+	if status == http.StatusBadRequest {
+		b, buf, status, err = c.handleRejections(ctx, d, tenantID, headers, b, buf, err)
+	}
+	if err == nil || c.config.deadLetters == nil {
+		return err
+	}
+
+	letter := newDeadLetter(d, tenantID, b, enc, buf, status, err)
+	if putErr := c.config.deadLetters.Put(ctx, letter); putErr != nil {
+		return errors.Join(err, putErr)
+	}
+	level.Warn(*c.log).Log("msg", fmt.Sprintf("wrote batch of %d log lines to the dead-letter sink", letter.Entries), "destination", d.name, "tenant", tenantID) // nolint:errcheck
+	return nil
+}
+
+// sendWithRetries sends an encoded batch, retrying 429s, 500s and
+// connection-level errors. It returns the status of the last attempt.
+func (c *promtailClient) sendWithRetries(ctx context.Context, d *destination, tenantID string, headers http.Header, enc *pushEncoder, buf []byte) (int, error) {
+	// Stop sending and retrying in time for the invocation to return an error
+	// before Lambda kills it.
+	ctx, cancel := withSendDeadline(ctx)
+	defer cancel()
+
+	throttle := c.throttle(d, tenantID)
+	var err error
 	backoff := backoff.New(ctx, *c.config.backoff)
 	var status int
+	var refreshed bool
 	for {
-		// send uses `timeout` internally, so `context.Background` is good enough.
-		status, err = c.send(context.Background(), buf)
+		if waitErr := throttle.wait(ctx); waitErr != nil {
+			if err == nil {
+				err = waitErr
+			}
+			break
+		}
+		status, err = c.send(ctx, d, tenantID, headers, enc, buf)
+		// Credentials that expired, were rotated or revoked are fetched again
+		// once.
+		if isAuthFailure(status) && !refreshed && d.refreshCredentials() {
+			refreshed = true
+			level.Warn(*c.log).Log("msg", "credentials rejected, fetching them again", "destination", d.name, "tenant", tenantID) // nolint:errcheck
+			continue
+		}
+		if isRateLimited(status) {
+			throttle.throttled(retryAfter(err))
+		} else if err == nil {
+			throttle.succeeded()
+		}
 
 		// Only retry 429s, 500s and connection-level errors.
 		if status > 0 && status != 429 && status/100 != 5 {
 			break
 		}
-		level.Error(*c.log).Log("err", fmt.Errorf("error sending batch, will retry, status: %d error: %s", status, err)) // nolint:errcheck
-		backoff.Wait()
+		level.Error(*c.log).Log("destination", d.name, "tenant", tenantID, "err", fmt.Errorf("error sending batch, will retry, status: %d error: %s", status, err)) // nolint:errcheck
+
+		// Wait for as long as Loki asks to, if that is longer than the backoff.
+		delay := max(backoff.NextDelay(), retryAfter(err))
 
 		// Make sure it sends at least once before checking for retry.
-		if !backoff.Ongoing() {
+		if !backoff.Ongoing() || sleep(ctx, delay) != nil {
 			break
 		}
 	}
 
 	if err != nil {
-		level.Error(*c.log).Log("err", fmt.Errorf("failed to send logs! %s", err)) // nolint:errcheck
-		return err
+		level.Error(*c.log).Log("destination", d.name, "tenant", tenantID, "err", fmt.Errorf("failed to send logs! %s", err)) // nolint:errcheck
+		return status, err
 	}
 
-	return nil
+	return status, nil
+}
+
+// handleRejections handles a 400 response that only rejects some entries of
+// the batch. Loki accepted the others, so only the rejected entries are
+// dropped, or clamped and sent again, depending on REJECTED_ENTRIES. It
+// returns what is left unsent and the error of sending it, the batch and error
+// as they are when the response can't be handled.
+func (c *promtailClient) handleRejections(ctx context.Context, d *destination, tenantID string, headers http.Header, b *batch, buf []byte, err error) (*batch, []byte, int, error) {
+	status := http.StatusBadRequest
+	policy := c.config.rejectedEntries
+	if policy != rejectedEntriesDrop && policy != rejectedEntriesClamp {
+		return b, buf, status, err
+	}
+	var respErr *responseError
+	if !errors.As(err, &respErr) {
+		return b, buf, status, err
+	}
+	rejections, ok := parseRejections(respErr.body)
+	if !ok {
+		return b, buf, status, err
+	}
+	resend, dropped := splitRejected(b, rejections, policy == rejectedEntriesClamp)
+	if len(resend.streams) == 0 && len(dropped) == 0 {
+		// None of the rejections could be traced back to the entries.
+		return b, buf, status, err
+	}
+	c.logRejected(d, tenantID, dropped)
+	if len(resend.streams) == 0 {
+		return nil, nil, status, nil
+	}
+
+	enc := c.encoder()
+	buf, _, err = resend.encode(enc)
+	if err != nil {
+		return resend, nil, 0, err
+	}
+	status, err = c.sendWithRetries(ctx, d, tenantID, headers, enc, buf)
+	if err == nil {
+		level.Info(*c.log).Log("msg", fmt.Sprintf("sent %d clamped log lines", resend.entriesCount()), "destination", d.name, "tenant", tenantID) // nolint:errcheck
+		return nil, nil, status, nil
+	}
+	// Entries rejected again are dropped rather than clamped twice.
+	if errors.As(err, &respErr) && status == http.StatusBadRequest {
+		if rejections, ok := parseRejections(respErr.body); ok {
+			if _, dropped := splitRejected(resend, rejections, false); len(dropped) > 0 {
+				c.logRejected(d, tenantID, dropped)
+				return nil, nil, status, nil
+			}
+		}
+	}
+	return resend, buf, status, err
+}
+
+func (c *promtailClient) logRejected(d *destination, tenantID string, dropped map[rejectionReason]int) {
+	if len(dropped) == 0 {
+		return
+	}
+	var count int
+	for _, n := range dropped {
+		count += n
+	}
+	level.Warn(*c.log).Log("msg", fmt.Sprintf("dropped %d log lines rejected by Loki", count), "destination", d.name, "tenant", tenantID, "reasons", formatRejected(dropped)) // nolint:errcheck
 }
 
-func (c *promtailClient) send(ctx context.Context, buf []byte) (int, error) {
+func (c *promtailClient) send(ctx context.Context, d *destination, tenantID string, headers http.Header, enc *pushEncoder, buf []byte) (int, error) {
 	ctx, cancel := context.WithTimeout(ctx, c.config.http.timeout)
 	defer cancel()
 
-	req, err := http.NewRequest("POST", writeAddress.String(), bytes.NewReader(buf))
+	req, err := http.NewRequest("POST", d.writeAddress.String(), bytes.NewReader(buf))
 	if err != nil {
 		return -1, err
 	}
-	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Type", enc.contentType)
+	if enc.contentEncoding != "" {
+		req.Header.Set("Content-Encoding", enc.contentEncoding)
+	}
 	req.Header.Set("User-Agent", userAgent)
 
 	if tenantID != "" {
 		req.Header.Set("X-Scope-OrgID", tenantID)
 	}
 
-	if username != "" && password != "" {
+	if err := d.setHeaders(ctx, req, headers, c.log); err != nil {
+		return -1, err
+	}
+
+	if d.username != nil && d.password != nil {
+		username, err := d.username.get(ctx, c.log)
+		if err != nil {
+			return -1, err
+		}
+		password, err := d.password.get(ctx, c.log)
+		if err != nil {
+			return -1, err
+		}
 		req.SetBasicAuth(username, password)
 	}
 
-	if bearerToken != "" {
+	if d.bearerToken != nil {
+		bearerToken, err := d.bearerToken.get(ctx, c.log)
+		if err != nil {
+			return -1, err
+		}
 		req.Header.Set("Authorization", "Bearer "+bearerToken)
 	}
 
-	resp, err := c.http.Do(req.WithContext(ctx))
+	if d.oauth2 != nil {
+		token, err := d.oauth2.token(ctx, c.log)
+		if err != nil {
+			return -1, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	if d.sigv4 != nil {
+		if err := d.sigv4.sign(ctx, req, buf); err != nil {
+			return -1, err
+		}
+	}
+
+	resp, err := c.httpClient(d).Do(req.WithContext(ctx))
 	if err != nil {
 		return -1, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode/100 != 2 {
-		scanner := bufio.NewScanner(io.LimitReader(resp.Body, maxErrMsgLen))
-		line := ""
-		if scanner.Scan() {
-			line = scanner.Text()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrBodyLen))
+		line, _, _ := strings.Cut(string(body), "\n")
+		if len(line) > maxErrMsgLen {
+			line = line[:maxErrMsgLen]
 		}
-		err = fmt.Errorf("server returned HTTP status %s (%d): %s", resp.Status, resp.StatusCode, line)
+		respErr := &responseError{
+			msg:  fmt.Sprintf("server returned HTTP status %s (%d): %s", resp.Status, resp.StatusCode, line),
+			body: string(body),
+		}
+		if isRateLimited(resp.StatusCode) {
+			respErr.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		}
+		err = respErr
 	}
 
 	return resp.StatusCode, err
 }
+
+// isAuthFailure reports whether the status rejects the credentials.
+func isAuthFailure(status int) bool {
+	return status == http.StatusUnauthorized || status == http.StatusForbidden
+}
+
+// responseError is returned when Loki responds with a non-2xx status.
+type responseError struct {
+	msg string
+	// body of the response, for the errors about single entries
+	body string
+	// Retry-After of a 429 or 503 response
+	retryAfter time.Duration
+}
+
+func (e *responseError) Error() string {
+	return e.msg
+}
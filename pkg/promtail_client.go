@@ -3,7 +3,11 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/go-kit/log"
@@ -19,33 +23,110 @@ type promtailClient struct {
 	config *promtailClientConfig
 	http   *http.Client
 	log    *log.Logger
+	// clients of the destinations with their own TLS configuration, so that
+	// a client certificate is only presented to the destination it is for
+	destinationClients map[*destination]*http.Client
+
+	// throttles of the tenants of the destinations, by destination name and
+	// tenant
+	throttlesMu sync.Mutex
+	throttles   map[string]*throttle
 }
 
 type promtailClientConfig struct {
-	backoff *backoff.Config
-	http    *httpClientConfig
+	backoff      *backoff.Config
+	http         *httpClientConfig
+	destinations []*destination
+	// receives the batches that fail to be sent, nil to return an error instead
+	deadLetters deadLetterSink
+	// what to do with the entries Loki rejects in a 400 response, one of
+	// drop, clamp or fail
+	rejectedEntries string
+	// wire format of the push requests, one of protobuf, json or json-gzip,
+	// protobuf if empty
+	pushFormat string
 }
 
 type httpClientConfig struct {
 	timeout       time.Duration
 	skipTLSVerify bool
+	// custom CA and client certificate, nil to use the system CAs only
+	tls *tls.Config
 }
 
 func NewPromtailClient(cfg *promtailClientConfig, log *log.Logger) Client {
+	destinationClients := map[*destination]*http.Client{}
+	for _, d := range cfg.destinations {
+		if d.tls != nil {
+			httpConfig := *cfg.http
+			httpConfig.tls = d.tls
+			destinationClients[d] = NewHTTPClient(&httpConfig)
+		}
+	}
 	return &promtailClient{
-		config: cfg,
-		http:   NewHTTPClient(cfg.http),
-		log:    log,
+		config:             cfg,
+		http:               NewHTTPClient(cfg.http),
+		log:                log,
+		destinationClients: destinationClients,
+	}
+}
+
+// httpClient returns the client to send the requests to d with.
+func (c *promtailClient) httpClient(d *destination) *http.Client {
+	if client, ok := c.destinationClients[d]; ok {
+		return client
 	}
+	return c.http
 }
 
 func NewHTTPClient(cfg *httpClientConfig) *http.Client {
 	transport := http.DefaultTransport
-	if cfg.skipTLSVerify {
-		transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}} //#nosec G402 -- User has explicitly requested to disable TLS
+	if cfg.skipTLSVerify || cfg.tls != nil {
+		tlsConfig := &tls.Config{}
+		if cfg.tls != nil {
+			tlsConfig = cfg.tls.Clone()
+		}
+		if cfg.skipTLSVerify {
+			tlsConfig.InsecureSkipVerify = true //#nosec G402 -- User has explicitly requested to disable TLS
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = tlsConfig
+		transport = t
 	}
 	return &http.Client{
 		Timeout:   cfg.timeout,
 		Transport: transport,
 	}
 }
+
+// newTLSConfig returns the TLS configuration trusting the PEM-encoded CA
+// certificates next to the system ones, and presenting the client certificate
+// if there is one. It returns nil if there is nothing to configure.
+func newTLSConfig(caCert, clientCert, clientKey string) (*tls.Config, error) {
+	if caCert == "" && clientCert == "" && clientKey == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caCert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(caCert)) {
+			return nil, errors.New("no PEM-encoded certificate found in the CA certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if clientCert != "" || clientKey != "" {
+		if clientCert == "" || clientKey == "" {
+			return nil, errors.New("both the client certificate and key must be set if either one is set")
+		}
+		cert, err := tls.X509KeyPair([]byte(clientCert), []byte(clientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/backoff"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/stretchr/testify/require"
+)
+
+// testCertificate is a certificate and key, PEM-encoded.
+type testCertificate struct {
+	cert, key string
+	parsed    *x509.Certificate
+	signer    *ecdsa.PrivateKey
+}
+
+// newTestCertificate creates a certificate signed by parent, or a self-signed
+// CA if parent is nil.
+func newTestCertificate(t *testing.T, parent *testCertificate, name string) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	issuer, issuerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		issuer, issuerKey = parent.parsed, parent.signer
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, issuerKey)
+	require.NoError(t, err)
+	parsed, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return &testCertificate{
+		cert:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		key:    string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		parsed: parsed,
+		signer: key,
+	}
+}
+
+func TestNewHTTPClient_mutualTLS(t *testing.T) {
+	ca := newTestCertificate(t, nil, "internal CA")
+	serverCert := newTestCertificate(t, ca, "loki")
+	clientCert := newTestCertificate(t, ca, "lambda-promtail")
+
+	serverKeyPair, err := tls.X509KeyPair([]byte(serverCert.cert), []byte(serverCert.key))
+	require.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.parsed)
+
+	loki := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "lambda-promtail", r.TLS.PeerCertificates[0].Subject.CommonName)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	loki.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverKeyPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	loki.StartTLS()
+	defer loki.Close()
+
+	for name, tc := range map[string]struct {
+		caCert, clientCert, clientKey string
+		wantErr                       bool
+	}{
+		"custom CA and client certificate": {caCert: ca.cert, clientCert: clientCert.cert, clientKey: clientCert.key},
+		"without client certificate":       {caCert: ca.cert, wantErr: true},
+		"without CA":                       {clientCert: clientCert.cert, clientKey: clientCert.key, wantErr: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tlsConfig, err := newTLSConfig(tc.caCert, tc.clientCert, tc.clientKey)
+			require.NoError(t, err)
+			client := NewHTTPClient(&httpClientConfig{timeout: time.Second, tls: tlsConfig})
+
+			resp, err := client.Get(loki.URL)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusNoContent, resp.StatusCode)
+		})
+	}
+}
+
+func Test_newTLSConfig(t *testing.T) {
+	ca := newTestCertificate(t, nil, "internal CA")
+
+	tlsConfig, err := newTLSConfig("", "", "")
+	require.NoError(t, err)
+	require.Nil(t, tlsConfig)
+
+	_, err = newTLSConfig("not a certificate", "", "")
+	require.ErrorContains(t, err, "no PEM-encoded certificate found")
+
+	_, err = newTLSConfig("", ca.cert, "")
+	require.ErrorContains(t, err, "both the client certificate and key must be set")
+
+	other := newTestCertificate(t, nil, "other")
+	_, err = newTLSConfig("", ca.cert, other.key)
+	require.ErrorContains(t, err, "invalid client certificate")
+}
+
+func Test_promtailClient_destinationTLS(t *testing.T) {
+	ca := newTestCertificate(t, nil, "internal CA")
+	serverCert := newTestCertificate(t, ca, "loki")
+	clientCert := newTestCertificate(t, ca, "lambda-promtail")
+
+	serverKeyPair, err := tls.X509KeyPair([]byte(serverCert.cert), []byte(serverCert.key))
+	require.NoError(t, err)
+	var (
+		mu         sync.Mutex
+		clientCNs  = map[string]string{}
+		clientCAs  = x509.NewCertPool()
+		secretsArn = "arn:aws:secretsmanager:us-east-1:123456789012:secret:lambda-promtail-key"
+	)
+	clientCAs.AddCert(ca.parsed)
+	loki := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		clientCNs[r.URL.Path] = ""
+		if len(r.TLS.PeerCertificates) > 0 {
+			clientCNs[r.URL.Path] = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	loki.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverKeyPair},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    clientCAs,
+	}
+	loki.StartTLS()
+	defer loki.Close()
+
+	// The client key is fetched from an ARN, like the credentials.
+	secrets := &testSecretsClient{ReturnValue: clientCert.key}
+	destinations, err := parseDestinations(context.Background(), secrets, `[{
+		"name": "mtls",
+		"write_address": "`+loki.URL+`/mtls",
+		"tls": {"ca_cert": `+jsonString(t, ca.cert)+`, "client_cert": `+jsonString(t, clientCert.cert)+`, "client_key": "`+secretsArn+`"}
+	}, {
+		"name": "ca-only",
+		"write_address": "`+loki.URL+`/ca-only",
+		"tls": {"ca_cert": `+jsonString(t, ca.cert)+`}
+	}, {
+		"name": "system-cas",
+		"write_address": "`+loki.URL+`/system-cas"
+	}]`)
+	require.NoError(t, err)
+	require.Equal(t, 1, secrets.CallsFetchFromAWSSecretsManager)
+
+	logger := log.NewNopLogger()
+	client := NewPromtailClient(&promtailClientConfig{
+		backoff:      &backoff.Config{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 1},
+		http:         &httpClientConfig{timeout: time.Second},
+		destinations: destinations,
+	}, &logger)
+	b := &batch{streams: map[string]*logproto.Stream{
+		`{app="a"}`: {Labels: `{app="a"}`, Entries: []logproto.Entry{{Timestamp: time.Now(), Line: "hello"}}},
+	}}
+	err = client.sendToPromtail(context.Background(), b)
+	require.ErrorContains(t, err, "system-cas")
+	require.ErrorContains(t, err, "certificate")
+
+	// Only the destination with the client certificate presents it.
+	require.Equal(t, map[string]string{"/mtls": "lambda-promtail", "/ca-only": ""}, clientCNs)
+
+	_, err = parseDestinations(context.Background(), secrets, `[{"write_address": "https://loki.example.com", "tls": {"client_cert": `+jsonString(t, clientCert.cert)+`}}]`)
+	require.ErrorContains(t, err, "invalid tls: both the client certificate and key must be set")
+}
+
+func jsonString(t *testing.T, s string) string {
+	t.Helper()
+	encoded, err := json.Marshal(s)
+	require.NoError(t, err)
+	return string(encoded)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/backoff"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatch_tenantBatches(t *testing.T) {
+	batchSize = 131072
+
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	b, err := newBatch(context.Background(), nil, process,
+		entry{labels: model.LabelSet{"app": "a"}, entry: logproto.Entry{Line: "default", Timestamp: time.Now()}},
+		entry{labels: model.LabelSet{"app": "a", reservedLabelTenantID: "team-1"}, entry: logproto.Entry{Line: "team 1", Timestamp: time.Now()}},
+		entry{labels: model.LabelSet{"app": "a", reservedLabelTenantID: "team-2"}, entry: logproto.Entry{Line: "team 2", Timestamp: time.Now()}},
+		entry{labels: model.LabelSet{"app": "b", reservedLabelTenantID: "team-2"}, entry: logproto.Entry{Line: "team 2", Timestamp: time.Now()}},
+	)
+	require.NoError(t, err)
+	require.Len(t, b.streams, 4)
+
+	tenants := b.tenantBatches()
+	require.Len(t, tenants, 3)
+	for tenantID, want := range map[string][]string{
+		"":       {`{app="a"}`},
+		"team-1": {`{app="a"}`},
+		"team-2": {`{app="a"}`, `{app="b"}`},
+	} {
+		req, _ := tenants[tenantID].createPushRequest()
+		var got []string
+		for _, stream := range req.Streams {
+			got = append(got, stream.Labels)
+		}
+		require.ElementsMatch(t, want, got, tenantID)
+	}
+
+	b.resetBatch()
+	require.Empty(t, b.tenantIDs)
+}
+
+func Test_promtailClient_tenants(t *testing.T) {
+	batchSize = 131072
+	keepStream = false
+
+	loki := newLokiServer(t, http.StatusNoContent)
+	destinations, err := parseDestinations(context.Background(), &testSecretsClient{}, `[
+		{"name": "loki", "write_address": "`+loki.URL+`", "tenant_id": "fallback"}
+	]`)
+	require.NoError(t, err)
+
+	logger := log.NewNopLogger()
+	client := NewPromtailClient(&promtailClientConfig{
+		backoff:      &backoff.Config{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 1},
+		http:         &httpClientConfig{timeout: time.Second},
+		destinations: destinations,
+	}, &logger)
+
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	b, err := newBatch(context.Background(), nil, process,
+		entry{labels: model.LabelSet{"app": "a"}, entry: logproto.Entry{Line: "default", Timestamp: time.Now()}},
+		entry{labels: model.LabelSet{"app": "a", reservedLabelTenantID: "team-1"}, entry: logproto.Entry{Line: "team 1", Timestamp: time.Now()}},
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, client.sendToPromtail(context.Background(), b))
+	require.ElementsMatch(t, []string{"fallback", "team-1"}, loki.orgIDs)
+	require.Equal(t, []string{`{app="a"}`, `{app="a"}`}, loki.streams)
+}
+
+func TestBatch_deadline(t *testing.T) {
+	batchSize = 131072
+
+	client := &failingPromtailClient{}
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	b, err := newBatch(context.Background(), client, process,
+		entry{labels: model.LabelSet{"app": "a"}, entry: logproto.Entry{Line: "first", Timestamp: time.Now()}},
+		entry{labels: model.LabelSet{"app": "a"}, entry: logproto.Entry{Line: "second", Timestamp: time.Now()}},
+	)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), deadlineFlushMargin/2)
+	defer cancel()
+	err = b.add(ctx, entry{labels: model.LabelSet{"app": "a"}, entry: logproto.Entry{Line: "third", Timestamp: time.Now()}})
+
+	var deadlineErr *deadlineError
+	require.ErrorAs(t, err, &deadlineErr)
+	require.Equal(t, 3, deadlineErr.sent)
+	require.Equal(t, 3, client.sent)
+	require.Empty(t, b.streams)
+	require.Contains(t, err.Error(), "after sending 3 log lines")
+}
+
+func Test_promtailClient_deadline(t *testing.T) {
+	batchSize = 131072
+
+	loki := newLokiServer(t, http.StatusServiceUnavailable)
+	destinations, err := parseDestinations(context.Background(), &testSecretsClient{}, `[{"write_address": "`+loki.URL+`"}]`)
+	require.NoError(t, err)
+
+	logger := log.NewNopLogger()
+	client := NewPromtailClient(&promtailClientConfig{
+		backoff:      &backoff.Config{MinBackoff: 50 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, MaxRetries: 1000},
+		http:         &httpClientConfig{timeout: time.Second},
+		destinations: destinations,
+	}, &logger)
+
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	b, err := newBatch(context.Background(), client, process,
+		entry{labels: model.LabelSet{"app": "a"}, entry: logproto.Entry{Line: "line", Timestamp: time.Now()}},
+	)
+	require.NoError(t, err)
+
+	deadline := time.Now().Add(deadlineSendMargin + 300*time.Millisecond)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	err = b.flushBatch(ctx)
+	var deadlineErr *deadlineError
+	require.ErrorAs(t, err, &deadlineErr)
+	require.Equal(t, 0, deadlineErr.sent)
+	require.True(t, time.Now().Before(deadline), "retries must stop before the deadline")
+	require.NotEmpty(t, loki.orgIDs)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+const (
+	rejectedEntriesDrop  = "drop"
+	rejectedEntriesClamp = "clamp"
+	rejectedEntriesFail  = "fail"
+
+	// how far past the oldest acceptable timestamp old entries are clamped to,
+	// so that they are still accepted once sent again
+	rejectionClampMargin = time.Minute
+
+	// layout of time.Time.String(), used by the ingesters for the timestamps
+	// of the entries they ignore
+	timeStringLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+)
+
+type rejectionReason string
+
+const (
+	rejectionTooOld       rejectionReason = "greater_than_max_sample_age"
+	rejectionTooFarBehind rejectionReason = "too_far_behind"
+	rejectionOutOfOrder   rejectionReason = "out_of_order"
+	rejectionTooNew       rejectionReason = "too_far_in_future"
+	rejectionLineTooLong  rejectionReason = "line_too_long"
+)
+
+// rejection is a single entry Loki rejected in a 400 response.
+type rejection struct {
+	reason rejectionReason
+	stream string
+	// timestamp of the rejected entry
+	timestamp time.Time
+	// oldest acceptable timestamp, for too old and too far behind entries
+	cutoff time.Time
+	// maximum size of a line, for lines too long
+	maxLineSize int
+}
+
+var (
+	tooOldRegex      = regexp.MustCompile(`entry for stream '(\{.*?\})' has timestamp too old: (\S+), oldest acceptable timestamp is: ([^\s,;]+)`)
+	tooNewRegex      = regexp.MustCompile(`entry for stream '(\{.*?\})' has timestamp too new: ([^\s,;]+)`)
+	lineTooLongRegex = regexp.MustCompile(`max entry size '(\d+)' bytes exceeded for stream '(\{.*?\})' while adding an entry with length '\d+' bytes`)
+	// the entries an ingester ignored, followed by the stream they belong to
+	ignoredEntriesRegex = regexp.MustCompile(`((?:entry with timestamp [^\n]+? ignored, reason: '[^\n]*?',\n)+)user '[^\n]*?', total ignored: \d+ out of \d+ for stream: (\{[^\n]*\})`)
+	ignoredEntryRegex   = regexp.MustCompile(`entry with timestamp ([^\n]+?) ignored, reason: '([^\n]*?)',\n`)
+	tooFarBehindRegex   = regexp.MustCompile(`^entry too far behind, entry timestamp is: \S+, oldest acceptable timestamp is: (\S+)$`)
+	groupedErrorsRegex  = regexp.MustCompile(`\d+ errors like: `)
+)
+
+// parseRejections parses the body of a 400 response from Loki. It returns
+// false when the response rejects more than single entries, for instance a
+// stream with invalid labels.
+func parseRejections(body string) ([]rejection, bool) {
+	var rejections []rejection
+	rest := body
+
+	var parseErr error
+	rest = tooOldRegex.ReplaceAllStringFunc(rest, func(m string) string {
+		match := tooOldRegex.FindStringSubmatch(m)
+		timestamp, err := time.Parse(time.RFC3339, match[2])
+		if err != nil {
+			parseErr = err
+		}
+		cutoff, err := time.Parse(time.RFC3339, match[3])
+		if err != nil {
+			parseErr = err
+		}
+		rejections = append(rejections, rejection{reason: rejectionTooOld, stream: match[1], timestamp: timestamp, cutoff: cutoff})
+		return ""
+	})
+	rest = tooNewRegex.ReplaceAllStringFunc(rest, func(m string) string {
+		match := tooNewRegex.FindStringSubmatch(m)
+		timestamp, err := time.Parse(time.RFC3339, match[2])
+		if err != nil {
+			parseErr = err
+		}
+		rejections = append(rejections, rejection{reason: rejectionTooNew, stream: match[1], timestamp: timestamp})
+		return ""
+	})
+	rest = lineTooLongRegex.ReplaceAllStringFunc(rest, func(m string) string {
+		match := lineTooLongRegex.FindStringSubmatch(m)
+		maxLineSize, err := strconv.Atoi(match[1])
+		if err != nil {
+			parseErr = err
+		}
+		rejections = append(rejections, rejection{reason: rejectionLineTooLong, stream: match[2], maxLineSize: maxLineSize})
+		return ""
+	})
+	rest = ignoredEntriesRegex.ReplaceAllStringFunc(rest, func(m string) string {
+		match := ignoredEntriesRegex.FindStringSubmatch(m)
+		for _, entry := range ignoredEntryRegex.FindAllStringSubmatch(match[1], -1) {
+			timestamp, err := time.Parse(timeStringLayout, entry[1])
+			if err != nil {
+				parseErr = err
+			}
+			r := rejection{stream: match[2], timestamp: timestamp}
+			if behind := tooFarBehindRegex.FindStringSubmatch(entry[2]); behind != nil {
+				r.reason = rejectionTooFarBehind
+				if r.cutoff, err = time.Parse(time.RFC3339, behind[1]); err != nil {
+					parseErr = err
+				}
+			} else if entry[2] == "entry out of order" {
+				r.reason = rejectionOutOfOrder
+			} else {
+				// Rate limits and the like aren't about the entry itself.
+				parseErr = fmt.Errorf("unknown reason %q", entry[2])
+			}
+			rejections = append(rejections, r)
+		}
+		return ""
+	})
+	rest = groupedErrorsRegex.ReplaceAllString(rest, "")
+
+	if parseErr != nil || strings.Trim(rest, "; \n") != "" {
+		return nil, false
+	}
+	return rejections, true
+}
+
+// matches reports whether the entry of the stream is the rejected one.
+func (r *rejection) matches(stream string, e *logproto.Entry) bool {
+	if r.stream != stream {
+		return false
+	}
+	switch r.reason {
+	case rejectionTooOld, rejectionTooFarBehind:
+		return e.Timestamp.Before(r.cutoff) || e.Timestamp.Equal(r.timestamp) || e.Timestamp.Truncate(time.Second).Equal(r.timestamp)
+	case rejectionTooNew:
+		// Entries newer than a rejected one are too new as well.
+		return !e.Timestamp.Truncate(time.Second).Before(r.timestamp)
+	case rejectionOutOfOrder:
+		return e.Timestamp.Equal(r.timestamp)
+	case rejectionLineTooLong:
+		return len(e.Line) > r.maxLineSize
+	}
+	return false
+}
+
+// clamp changes the entry so that Loki accepts it. It returns false if the
+// rejection can't be fixed.
+func (r *rejection) clamp(e *logproto.Entry) bool {
+	switch r.reason {
+	case rejectionTooOld, rejectionTooFarBehind:
+		e.Timestamp = r.cutoff.Add(rejectionClampMargin)
+	case rejectionTooNew:
+		e.Timestamp = time.Now()
+	case rejectionLineTooLong:
+		e.Line = truncateLine(e.Line, r.maxLineSize)
+	default:
+		return false
+	}
+	return true
+}
+
+// truncateLine cuts a line to at most size bytes, without splitting a rune.
+func truncateLine(line string, size int) string {
+	if len(line) <= size {
+		return line
+	}
+	// Back off to the start of the rune the cut falls in.
+	for size > 0 && !utf8.RuneStart(line[size]) {
+		size--
+	}
+	return line[:size]
+}
+
+// splitRejected finds the entries of the batch matching the rejections. With
+// clamp, the entries that can be fixed are returned in a new batch, the others
+// are counted in dropped by reason.
+func splitRejected(b *batch, rejections []rejection, clamp bool) (resend *batch, dropped map[rejectionReason]int) {
+	resend = &batch{streams: map[string]*logproto.Stream{}}
+	dropped = map[rejectionReason]int{}
+
+	for key, stream := range b.streams {
+	Entries:
+		for _, e := range stream.Entries {
+			for i := range rejections {
+				r := &rejections[i]
+				if !r.matches(stream.Labels, &e) {
+					continue
+				}
+				if clamp && r.clamp(&e) {
+					rs, ok := resend.streams[key]
+					if !ok {
+						rs = &logproto.Stream{Labels: stream.Labels}
+						resend.streams[key] = rs
+						if tenantID, ok := b.tenantIDs[key]; ok {
+							if resend.tenantIDs == nil {
+								resend.tenantIDs = map[string]string{}
+							}
+							resend.tenantIDs[key] = tenantID
+						}
+					}
+					rs.Entries = append(rs.Entries, e)
+				} else {
+					dropped[r.reason]++
+				}
+				continue Entries
+			}
+		}
+	}
+	return resend, dropped
+}
+
+func formatRejected(dropped map[rejectionReason]int) string {
+	reasons := make([]string, 0, len(dropped))
+	for reason, n := range dropped {
+		reasons = append(reasons, fmt.Sprintf("%s=%d", reason, n))
+	}
+	sort.Strings(reasons)
+	return strings.Join(reasons, ",")
+}
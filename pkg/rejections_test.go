@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/grafana/dskit/backoff"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func mustParseTime(t *testing.T, layout, value string) time.Time {
+	t.Helper()
+	ts, err := time.Parse(layout, value)
+	require.NoError(t, err)
+	return ts
+}
+
+func Test_parseRejections(t *testing.T) {
+	for name, tc := range map[string]struct {
+		body   string
+		want   []rejection
+		wantOK bool
+	}{
+		"distributor validation errors": {
+			body: "2 errors like: entry for stream '{app=\"a\"}' has timestamp too old: 2020-01-01T00:00:00Z, oldest acceptable timestamp is: 2024-01-01T00:00:00Z; " +
+				"entry for stream '{app=\"b\"}' has timestamp too new: 2030-01-01T00:00:00Z; " +
+				"max entry size '10' bytes exceeded for stream '{app=\"c\"}' while adding an entry with length '20' bytes\n",
+			want: []rejection{
+				{reason: rejectionTooOld, stream: `{app="a"}`, timestamp: mustParseTime(t, time.RFC3339, "2020-01-01T00:00:00Z"), cutoff: mustParseTime(t, time.RFC3339, "2024-01-01T00:00:00Z")},
+				{reason: rejectionTooNew, stream: `{app="b"}`, timestamp: mustParseTime(t, time.RFC3339, "2030-01-01T00:00:00Z")},
+				{reason: rejectionLineTooLong, stream: `{app="c"}`, maxLineSize: 10},
+			},
+			wantOK: true,
+		},
+		"ingester errors": {
+			body: "entry with timestamp 2024-01-01 00:00:00.5 +0000 UTC ignored, reason: 'entry too far behind, entry timestamp is: 2024-01-01T00:00:00Z, oldest acceptable timestamp is: 2024-01-01T01:00:00Z',\n" +
+				"entry with timestamp 2024-01-01 02:00:00 +0000 UTC ignored, reason: 'entry out of order',\n" +
+				"user 'fake', total ignored: 2 out of 5 for stream: {app=\"a\"}\n",
+			want: []rejection{
+				{reason: rejectionTooFarBehind, stream: `{app="a"}`, timestamp: mustParseTime(t, time.RFC3339Nano, "2024-01-01T00:00:00.5Z"), cutoff: mustParseTime(t, time.RFC3339, "2024-01-01T01:00:00Z")},
+				{reason: rejectionOutOfOrder, stream: `{app="a"}`, timestamp: mustParseTime(t, time.RFC3339, "2024-01-01T02:00:00Z")},
+			},
+			wantOK: true,
+		},
+		"errors about streams": {
+			body: "entry for stream '{app=\"b\"}' has timestamp too new: 2030-01-01T00:00:00Z; error parsing labels '{app=' with error: unexpected end of input\n",
+		},
+		"rate limited entries": {
+			body: "entry with timestamp 2024-01-01 00:00:00 +0000 UTC ignored, reason: 'Per stream rate limit exceeded',\n" +
+				"user 'fake', total ignored: 1 out of 1 for stream: {app=\"a\"}",
+		},
+		"unknown errors": {
+			body: "snappy: corrupt input",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, ok := parseRejections(tc.body)
+			require.Equal(t, tc.wantOK, ok)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func Test_splitRejected(t *testing.T) {
+	now := time.Now()
+	cutoff := now.Add(-time.Hour).Truncate(time.Second)
+	b := &batch{streams: map[string]*logproto.Stream{
+		`{app="a"}`: {Labels: `{app="a"}`, Entries: []logproto.Entry{
+			{Timestamp: cutoff.Add(-time.Minute), Line: "old"},
+			{Timestamp: now, Line: "accepted"},
+			{Timestamp: now, Line: "long line"},
+		}},
+		`{app="b"}`: {Labels: `{app="b"}`, Entries: []logproto.Entry{
+			{Timestamp: now.Add(time.Hour), Line: "new"},
+			{Timestamp: now.Add(2 * time.Hour), Line: "newer"},
+			{Timestamp: now.Add(-time.Minute), Line: "accepted"},
+		}},
+	}}
+	rejections := []rejection{
+		{reason: rejectionTooOld, stream: `{app="a"}`, timestamp: cutoff.Add(-time.Minute), cutoff: cutoff},
+		{reason: rejectionLineTooLong, stream: `{app="a"}`, maxLineSize: 8},
+		{reason: rejectionTooNew, stream: `{app="b"}`, timestamp: now.Add(time.Hour).Truncate(time.Second)},
+	}
+
+	resend, dropped := splitRejected(b, rejections, false)
+	require.Empty(t, resend.streams)
+	require.Equal(t, map[rejectionReason]int{rejectionTooOld: 1, rejectionLineTooLong: 1, rejectionTooNew: 2}, dropped)
+
+	resend, dropped = splitRejected(b, rejections, true)
+	require.Empty(t, dropped)
+	require.Equal(t, []logproto.Entry{
+		{Timestamp: cutoff.Add(rejectionClampMargin), Line: "old"},
+		{Timestamp: now, Line: "long lin"},
+	}, resend.streams[`{app="a"}`].Entries)
+	require.Len(t, resend.streams[`{app="b"}`].Entries, 2)
+	for _, e := range resend.streams[`{app="b"}`].Entries {
+		require.WithinDuration(t, time.Now(), e.Timestamp, time.Minute)
+	}
+}
+
+func Test_truncateLine(t *testing.T) {
+	require.Equal(t, "short", truncateLine("short", 10))
+	require.Equal(t, "abc", truncateLine("abcdef", 3))
+	// é is two bytes, it isn't cut in half.
+	require.Equal(t, "ab", truncateLine("abé", 3))
+	require.Equal(t, "abé", truncateLine("abé", 4))
+}
+
+// rejectingLokiServer rejects the entries older than cutoff, the way Loki
+// does, and records the lines of each request.
+type rejectingLokiServer struct {
+	*httptest.Server
+	requests [][]string
+}
+
+func newRejectingLokiServer(t *testing.T, cutoff time.Time) *rejectingLokiServer {
+	s := &rejectingLokiServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		buf, err := snappy.Decode(nil, body)
+		require.NoError(t, err)
+		var req logproto.PushRequest
+		require.NoError(t, proto.Unmarshal(buf, &req))
+
+		var lines, rejected []string
+		for _, stream := range req.Streams {
+			for _, e := range stream.Entries {
+				lines = append(lines, e.Line)
+				if e.Timestamp.Before(cutoff) {
+					rejected = append(rejected, "entry for stream '"+stream.Labels+"' has timestamp too old: "+e.Timestamp.Format(time.RFC3339)+", oldest acceptable timestamp is: "+cutoff.Format(time.RFC3339))
+				}
+			}
+		}
+		s.requests = append(s.requests, lines)
+		if len(rejected) > 0 {
+			http.Error(w, strings.Join(rejected, "; "), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func Test_promtailClient_rejectedEntries(t *testing.T) {
+	batchSize = 131072
+	keepStream = false
+
+	now := time.Now()
+	cutoff := now.Add(-time.Hour).Truncate(time.Second)
+
+	for _, tc := range []struct {
+		policy       string
+		wantErr      bool
+		wantRequests [][]string
+	}{
+		{policy: rejectedEntriesDrop, wantRequests: [][]string{{"old", "recent"}}},
+		{policy: rejectedEntriesClamp, wantRequests: [][]string{{"old", "recent"}, {"old"}}},
+		{policy: rejectedEntriesFail, wantErr: true, wantRequests: [][]string{{"old", "recent"}}},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			loki := newRejectingLokiServer(t, cutoff)
+			destinations, err := parseDestinations(context.Background(), &testSecretsClient{}, `[{"write_address": "`+loki.URL+`"}]`)
+			require.NoError(t, err)
+
+			logger := log.NewNopLogger()
+			client := NewPromtailClient(&promtailClientConfig{
+				backoff:         &backoff.Config{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 1},
+				http:            &httpClientConfig{timeout: time.Second},
+				destinations:    destinations,
+				rejectedEntries: tc.policy,
+			}, &logger)
+
+			process, _ := ParsePipelineConfigs("", nil, nil)
+			b, err := newBatch(context.Background(), nil, process,
+				entry{labels: model.LabelSet{"app": "a"}, entry: logproto.Entry{Line: "old", Timestamp: cutoff.Add(-time.Hour)}},
+				entry{labels: model.LabelSet{"app": "a"}, entry: logproto.Entry{Line: "recent", Timestamp: now}},
+			)
+			require.NoError(t, err)
+
+			err = client.sendToPromtail(context.Background(), b)
+			if tc.wantErr {
+				require.ErrorContains(t, err, "has timestamp too old")
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.wantRequests, loki.requests)
+		})
+	}
+}
@@ -3,15 +3,18 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"net/url"
 	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -21,7 +24,6 @@ import (
 
 	"github.com/grafana/loki/v3/pkg/logproto"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
@@ -41,6 +43,12 @@ type parserConfig struct {
 	skipHeaderCount int
 	// key of the metadata label to use as a value for the__aws_<logType>_owner label
 	ownerLabelKey string
+	// optional parser of the fields of a log line, which can be sent as __aws_<logType>_<field> structured metadata
+	fieldsParser func(labels map[string]string, line string) map[string]string
+	// if the first line is a header naming the space separated fields of each line, used instead of fieldsParser
+	fieldsFromHeader bool
+	// field to take the timestamp from instead of matching timestampRegex
+	timestampField string
 }
 
 const (
@@ -106,13 +114,13 @@ var (
 	s3AccessLogTimestampRegex = regexp.MustCompile(`\[(?P<timestamp>\d+\/\w+\/\d+:\d+:\d+:\d+ [\+-]\d+)\]`)
 	parsers                   = map[string]parserConfig{
 		FlowLogType: {
-			logTypeLabel:    "s3_vpc_flow",
-			filenameRegex:   defaultFilenameRegex,
-			ownerLabelKey:   "account_id",
-			timestampRegex:  defaultTimestampRegex,
-			timestampFormat: time.RFC3339,
-			timestampType:   "string",
-			skipHeaderCount: 1,
+			logTypeLabel:     "s3_vpc_flow",
+			filenameRegex:    defaultFilenameRegex,
+			ownerLabelKey:    "account_id",
+			fieldsFromHeader: true,
+			timestampField:   "start",
+			timestampType:    "unix",
+			skipHeaderCount:  1,
 		},
 		LbLogType: {
 			logTypeLabel:    "s3_lb",
@@ -121,6 +129,7 @@ var (
 			timestampFormat: time.RFC3339,
 			timestampRegex:  defaultTimestampRegex,
 			timestampType:   "string",
+			fieldsParser:    parseLbLogFields,
 		},
 		CloudTrailLogType: {
 			logTypeLabel:    "s3_cloudtrail",
@@ -170,9 +179,21 @@ var (
 			timestampType:   "string",
 		},
 	}
+	// parserOrder is the order getLabels tries the parsers in. The custom
+	// parsers are added first, in the order they are declared.
+	parserOrder = []string{
+		FlowLogType, LbLogType, CloudTrailLogType, CloudFrontLogType,
+		WafLogType, GuardDutyLogType, MskLogType, S3AccessLogType,
+	}
 )
 
+// guards s3Clients, which objects processed concurrently share
+var s3ClientsMu sync.Mutex
+
 func getS3Client(ctx context.Context, region string) (*s3.Client, error) {
+	s3ClientsMu.Lock()
+	defer s3ClientsMu.Unlock()
+
 	var s3Client *s3.Client
 
 	if c, ok := s3Clients[region]; ok {
@@ -189,6 +210,12 @@ func getS3Client(ctx context.Context, region string) (*s3.Client, error) {
 }
 
 func parseS3Log(ctx context.Context, b *batch, labels map[string]string, obj io.ReadCloser, log *log.Logger) error {
+	return parseS3LogFrom(ctx, b, labels, obj, log, nil)
+}
+
+// parseS3LogFrom parses an object resuming from the checkpoint of progress, and
+// records in it how far the lines were added to the batch.
+func parseS3LogFrom(ctx context.Context, b *batch, labels map[string]string, obj io.ReadCloser, log *log.Logger, progress *s3ObjectProgress) error {
 	parser, ok := parsers[labels["type"]]
 	if !ok {
 		if labels["type"] == CloudTrailDigestLogType {
@@ -197,18 +224,23 @@ func parseS3Log(ctx context.Context, b *batch, labels map[string]string, obj io.
 		return fmt.Errorf("could not find parser for type %s", labels["type"])
 	}
 
-	isGzip, reader, err := isGzipCompressed(obj)
-	if err != nil {
-		return err
-	}
-
-	if isGzip {
-		reader, err = gzip.NewReader(reader)
+	// A ranged read starts in the middle of an uncompressed object.
+	ranged := progress != nil && progress.ranged
+	reader, compressed := obj, false
+	if !ranged {
+		var err error
+		reader, compressed, err = decompressReader(obj, labels["key"])
 		if err != nil {
 			return err
 		}
-		defer reader.Close()
 	}
+	defer reader.Close()
+
+	magic, reader, err := peekReader(reader, len(parquetMagic))
+	if err != nil {
+		return err
+	}
+	isParquet := !ranged && (bytes.Equal(magic, parquetMagic) || strings.HasSuffix(labels["key"], ".parquet"))
 
 	scanner := bufio.NewScanner(reader)
 
@@ -218,8 +250,21 @@ func parseS3Log(ctx context.Context, b *batch, labels map[string]string, obj io.
 		model.LabelName(fmt.Sprintf("__aws_%s_owner", parser.logTypeLabel)): model.LabelValue(labels[parser.ownerLabelKey]),
 	}
 
+	metadata := structuredMetadata(ls, model.LabelSet{
+		model.LabelName("__aws_s3_bucket"): model.LabelValue(labels["bucket"]),
+		model.LabelName("__aws_s3_key"):    model.LabelValue(labels["key"]),
+	})
+
 	ls = applyLabels(ls)
 
+	if isParquet {
+		if err := parseParquetLog(ctx, b, parser, ls, metadata, reader); err != nil {
+			return err
+		}
+		progress.complete()
+		return nil
+	}
+
 	// extract the timestamp of the nested event and sends the rest as raw json
 	if labels["type"] == CloudTrailLogType || labels["type"] == GuardDutyLogType {
 		records := make(chan Record)
@@ -234,35 +279,84 @@ func parseS3Log(ctx context.Context, b *batch, labels map[string]string, obj io.
 			if err != nil {
 				return err
 			}
+			trailEntry.StructuredMetadata = metadata
 			if err := b.add(ctx, entry{ls, trailEntry}); err != nil {
 				return err
 			}
 		}
+		progress.complete()
 		return nil
 	}
 
+	// Only parse the fields of each line when they are needed for the timestamp or
+	// some of them are sent as structured metadata.
+	fieldsPrefix, fieldsMetadataEnabled := fieldsMetadataPrefix(parser)
+	parseFields := parser.fieldsFromHeader || (parser.fieldsParser != nil && fieldsMetadataEnabled)
+
+	resume := progress.resume()
+	var header []string
 	var lineCount int
+	var offset int64
+	if ranged {
+		lineCount, offset = resume.Lines, resume.Offset
+		header = strings.Fields(resume.Header)
+	}
+	if progress != nil {
+		// Byte offsets are only meaningful in uncompressed objects.
+		progress.trackOffset = !compressed
+	}
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		offset += int64(advance)
+		return advance, token, err
+	})
+
 	for scanner.Scan() {
 		logLine := scanner.Text()
 		lineCount++
+		if parser.fieldsFromHeader && lineCount == 1 {
+			header = strings.Fields(logLine)
+			progress.setHeader(logLine)
+		}
 		if lineCount <= parser.skipHeaderCount {
 			continue
 		}
+		// These lines were sent before the checkpoint.
+		if lineCount <= resume.Lines {
+			continue
+		}
 		if printLogLine {
 			fmt.Println(logLine)
 		}
 
+		var fields map[string]string
+		if parseFields {
+			if parser.fieldsFromHeader {
+				fields = parseHeaderFields(header, logLine)
+			} else {
+				fields = parser.fieldsParser(labels, logLine)
+			}
+		}
+
+		var rawTimestamp string
+		if parser.timestampField != "" {
+			rawTimestamp = fields[parser.timestampField]
+		} else if parser.timestampRegex != nil {
+			if match := parser.timestampRegex.FindStringSubmatch(logLine); len(match) > 0 {
+				rawTimestamp = match[1]
+			}
+		}
+
 		timestamp := time.Now()
-		match := parser.timestampRegex.FindStringSubmatch(logLine)
-		if len(match) > 0 {
+		if rawTimestamp != "" {
 			if labels["lb_type"] == LbNlbType {
 				// NLB logs don't have .SSSSSSZ suffix. RFC3339 requires a TZ specifier, use UTC
-				match[1] += "Z"
+				rawTimestamp += "Z"
 			}
 
 			switch parser.timestampType {
 			case "string":
-				timestamp, err = time.Parse(parser.timestampFormat, match[1])
+				timestamp, err = time.Parse(parser.timestampFormat, rawTimestamp)
 				if err != nil {
 					return err
 				}
@@ -270,7 +364,7 @@ func parseS3Log(ctx context.Context, b *batch, labels map[string]string, obj io.
 					timestamp = timestamp.UTC()
 				}
 			case "unix":
-				sec, nsec, err := getUnixSecNsec(match[1])
+				sec, nsec, err := getUnixSecNsec(rawTimestamp)
 				if err != nil {
 					return err
 				}
@@ -280,17 +374,54 @@ func parseS3Log(ctx context.Context, b *batch, labels map[string]string, obj io.
 			}
 		}
 
+		lineMetadata := metadata
+		if fieldsMetadataEnabled && fields != nil {
+			lineMetadata = append(metadata, fieldsMetadata(fieldsPrefix, fields)...)
+		}
+
+		progress.advance(lineCount, offset)
 		if err := b.add(ctx, entry{ls, logproto.Entry{
-			Line:      logLine,
-			Timestamp: timestamp,
+			Line:               logLine,
+			Timestamp:          timestamp,
+			StructuredMetadata: lineMetadata,
 		}}); err != nil {
 			return err
 		}
 	}
 
+	progress.complete()
 	return nil
 }
 
+// fieldsMetadataPrefix returns the prefix of the parsed fields of the parser's
+// log lines in STRUCTURED_METADATA, and whether any of them is listed.
+func fieldsMetadataPrefix(parser parserConfig) (string, bool) {
+	prefix := fmt.Sprintf("__aws_%s_", parser.logTypeLabel)
+	return prefix, slices.ContainsFunc(structuredMetadataLabels, func(name model.LabelName) bool {
+		return strings.HasPrefix(string(name), prefix)
+	})
+}
+
+// parseHeaderFields returns the space separated fields of line, keyed by the
+// names in header. Hyphens in the names are replaced by underscores so they are
+// valid label names, as in the account-id field of VPC flow logs. Fields logged
+// as "-" are omitted.
+// source: https://docs.aws.amazon.com/vpc/latest/userguide/flow-log-records.html
+func parseHeaderFields(header []string, line string) map[string]string {
+	values := strings.Fields(line)
+	fields := make(map[string]string, len(values))
+	for i, value := range values {
+		if i >= len(header) {
+			break
+		}
+		if value == "-" {
+			continue
+		}
+		fields[strings.ReplaceAll(header[i], "-", "_")] = value
+	}
+	return fields
+}
+
 func getLabels(record events.S3EventRecord) (map[string]string, error) {
 	labels := make(map[string]string)
 	labels["bucket"] = record.S3.Bucket.Name
@@ -301,18 +432,21 @@ func getLabels(record events.S3EventRecord) (map[string]string, error) {
 		return labels, fmt.Errorf("failed to decode S3 object key %q: %s", record.S3.Object.Key, err)
 	}
 	labels["key"] = decodedKey
-	for key, p := range parsers {
-		if p.filenameRegex.MatchString(labels["key"]) {
-			if labels["type"] == "" {
-				labels["type"] = key
-			}
-			match := p.filenameRegex.FindStringSubmatch(labels["key"])
-			for i, name := range p.filenameRegex.SubexpNames() {
-				if i != 0 && name != "" && match[i] != "" {
-					labels[name] = match[i]
-				}
+	// The first parser matching the key wins, so the labels of a key never
+	// depend on the iteration order of the parsers map.
+	for _, key := range parserOrder {
+		p := parsers[key]
+		match := p.filenameRegex.FindStringSubmatch(labels["key"])
+		if match == nil {
+			continue
+		}
+		labels["type"] = key
+		for i, name := range p.filenameRegex.SubexpNames() {
+			if i != 0 && name != "" && match[i] != "" {
+				labels[name] = match[i]
 			}
 		}
+		break
 	}
 	if labels["type"] == "" {
 		return labels, fmt.Errorf("type of S3 event could not be determined for object %q", record.S3.Object.Key)
@@ -320,41 +454,151 @@ func getLabels(record events.S3EventRecord) (map[string]string, error) {
 	return labels, nil
 }
 
+// s3ObjectError is the error of processing one of the objects of an S3 event.
+type s3ObjectError struct {
+	bucket, key string
+	err         error
+}
+
+func (e *s3ObjectError) Error() string {
+	return fmt.Sprintf("s3://%s/%s: %s", e.bucket, e.key, e.err)
+}
+
+func (e *s3ObjectError) Unwrap() error {
+	return e.err
+}
+
+func newS3ObjectError(record events.S3EventRecord, err error) error {
+	key, decodeErr := url.QueryUnescape(record.S3.Object.Key)
+	if decodeErr != nil {
+		key = record.S3.Object.Key
+	}
+	return &s3ObjectError{bucket: record.S3.Bucket.Name, key: key, err: err}
+}
+
 func processS3Event(ctx context.Context, ev *events.S3Event, pc Client, processingPipeline *LokiStages, log *log.Logger) error {
+	if s3Concurrency > 1 && len(ev.Records) > 1 {
+		return processS3RecordsConcurrently(ctx, ev, pc, processingPipeline, log)
+	}
+
 	batch, err := newBatch(ctx, pc, processingPipeline)
 	if err != nil {
 		return err
 	}
+
+	var progress *s3Progress
+	if checkpoints != nil {
+		progress = &s3Progress{store: checkpoints}
+		batch.saveProgress = progress.snapshot
+	}
+
 	for _, record := range ev.Records {
-		labels, err := getLabels(record)
-		if err != nil {
+		if err := processS3Record(ctx, batch, progress, record, log); err != nil {
 			return err
 		}
-		level.Info(*log).Log("msg", fmt.Sprintf("fetching s3 file: %s", labels["key"])) // nolint:errcheck
-		s3Client, err := getS3Client(ctx, labels["bucket_region"])
+	}
+
+	// There is nothing left to checkpoint once the last batch is sent.
+	batch.saveProgress = nil
+	err = batch.flushBatch(ctx)
+	if err != nil {
+		return err
+	}
+	progress.clear(ctx, log)
+
+	return nil
+}
+
+// processS3RecordsConcurrently fetches and parses up to S3_CONCURRENCY objects
+// at the same time, each into its own batch. An object failing doesn't stop
+// the others, and the error returned joins the s3ObjectError of each failed
+// object. The checkpoints of the objects sent are kept until every object of
+// the event is sent, so that a retry skips them.
+func processS3RecordsConcurrently(ctx context.Context, ev *events.S3Event, pc Client, processingPipeline *LokiStages, log *log.Logger) error {
+	errs := make([]error, len(ev.Records))
+	progresses := make([]*s3Progress, len(ev.Records))
+	runConcurrently(s3Concurrency, len(ev.Records), func(i int) {
+		record := ev.Records[i]
+		batch, err := newBatch(ctx, pc, processingPipeline)
 		if err != nil {
-			return err
+			errs[i] = err
+			return
 		}
-		obj, err := s3Client.GetObject(ctx,
-			&s3.GetObjectInput{
-				Bucket: aws.String(labels["bucket"]),
-				Key:    aws.String(labels["key"]),
-			})
-		if err != nil {
-			return fmt.Errorf("failed to get object %s from bucket %s, %s", labels["key"], labels["bucket"], err)
+		if checkpoints != nil {
+			progresses[i] = &s3Progress{store: checkpoints}
+			batch.saveProgress = progresses[i].snapshot
 		}
-		err = parseS3Log(ctx, batch, labels, obj.Body, log)
-		obj.Body.Close()
-		if err != nil {
-			return err
+		if err := processS3Record(ctx, batch, progresses[i], record, log); err != nil {
+			errs[i] = err
+			return
 		}
-	}
+		if err := batch.flushBatch(ctx); err != nil {
+			errs[i] = newS3ObjectError(record, err)
+		}
+	})
 
-	err = pc.sendToPromtail(ctx, batch)
+	err := errors.Join(errs...)
 	if err != nil {
+		for _, err := range errs {
+			if err != nil {
+				level.Error(*log).Log("msg", "failed to process s3 object", "err", err) // nolint:errcheck
+			}
+		}
 		return err
 	}
+	for _, progress := range progresses {
+		progress.clear(ctx, log)
+	}
+	return nil
+}
+
+// runConcurrently calls fn with each index below n, on up to limit goroutines
+// at a time.
+func runConcurrently(limit, n int, fn func(i int)) {
+	slots := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := range n {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			fn(i)
+		}()
+	}
+	wg.Wait()
+}
+
+// processS3Record fetches an object of the event and adds its lines to the
+// batch. Errors are returned as an s3ObjectError.
+func processS3Record(ctx context.Context, batch *batch, progress *s3Progress, record events.S3EventRecord, log *log.Logger) error {
+	labels, err := getLabels(record)
+	if err != nil {
+		return newS3ObjectError(record, err)
+	}
 
+	objProgress, err := progress.object(ctx, labels["bucket"], labels["key"])
+	if err != nil {
+		return newS3ObjectError(record, err)
+	}
+	if objProgress != nil && objProgress.checkpoint.Complete {
+		level.Info(*log).Log("msg", fmt.Sprintf("skipping s3 file sent by a previous attempt: %s", labels["key"])) // nolint:errcheck
+		return nil
+	}
+	level.Info(*log).Log("msg", fmt.Sprintf("fetching s3 file: %s", labels["key"])) // nolint:errcheck
+	s3Client, err := getS3Client(ctx, labels["bucket_region"])
+	if err != nil {
+		return newS3ObjectError(record, err)
+	}
+	obj, err := getS3Object(ctx, s3Client, labels["bucket"], labels["key"], objProgress)
+	if err != nil {
+		return newS3ObjectError(record, fmt.Errorf("failed to get object %s from bucket %s, %s", labels["key"], labels["bucket"], err))
+	}
+	err = parseS3LogFrom(ctx, batch, labels, obj.Body, log, objProgress)
+	obj.Body.Close()
+	if err != nil {
+		return newS3ObjectError(record, err)
+	}
 	return nil
 }
 
@@ -372,19 +616,36 @@ func processSNSEvent(ctx context.Context, evt *events.SNSEvent, handler func(ctx
 	return nil
 }
 
-func processSQSEvent(ctx context.Context, evt *events.SQSEvent, handler func(ctx context.Context, ev map[string]interface{}) error) error {
+// processSQSEvent hands each message body to handler, S3_CONCURRENCY messages at
+// a time. When REPORT_BATCH_ITEM_FAILURES is enabled, failed messages are
+// collected into the response instead of failing the whole batch, so only they
+// are redelivered.
+// https://docs.aws.amazon.com/lambda/latest/dg/services-sqs-errorhandling.html#services-sqs-batchfailurereporting
+func processSQSEvent(ctx context.Context, evt *events.SQSEvent, handler func(ctx context.Context, ev map[string]interface{}) error, log *log.Logger) (events.SQSEventResponse, error) {
+	// Messages are processed one at a time: S3_CONCURRENCY applies to the
+	// objects of each message, and would multiply with it otherwise.
+	var resp events.SQSEventResponse
 	for _, record := range evt.Records {
-		// retrieve nested
-		event, err := stringToRawEvent(record.Body)
-		if err != nil {
-			return err
+		err := processSQSMessage(ctx, record, handler)
+		if err == nil {
+			continue
 		}
-		err = handler(ctx, event)
-		if err != nil {
-			return err
+		if !reportBatchItemFailures {
+			return resp, err
 		}
+		level.Error(*log).Log("msg", fmt.Sprintf("failed to process SQS message %s", record.MessageId), "err", err) // nolint:errcheck
+		resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
 	}
-	return nil
+	return resp, nil
+}
+
+func processSQSMessage(ctx context.Context, record events.SQSMessage, handler func(ctx context.Context, ev map[string]interface{}) error) error {
+	// retrieve nested
+	event, err := stringToRawEvent(record.Body)
+	if err != nil {
+		return err
+	}
+	return handler(ctx, event)
 }
 
 func stringToRawEvent(body string) (map[string]interface{}, error) {
@@ -437,16 +698,11 @@ func getUnixSecNsec(s string) (sec int64, nsec int64, err error) {
 	return sec, nsec, err
 }
 
-// isGzipCompressed checks if the given reader contains gzip-compressed data
-// by checking for gzip magic numbers in the first 2 bytes of the stream
-// source: https://en.wikipedia.org/wiki/List_of_file_signatures
-func isGzipCompressed(reader io.ReadCloser) (bool, io.ReadCloser, error) {
-	buffer := make([]byte, 2)
-	numbers, err := reader.Read(buffer)
-
-	// Process bytes that were successfully read first
-	// Check for gzip magic numbers (0x1f, 0x8b)
-	isGzip := numbers >= 2 && buffer[0] == 0x1f && buffer[1] == 0x8b
+// peekReader returns up to the first n bytes of reader, along with a reader
+// that still yields the whole stream.
+func peekReader(reader io.ReadCloser, n int) ([]byte, io.ReadCloser, error) {
+	buffer := make([]byte, n)
+	numbers, err := io.ReadFull(reader, buffer)
 
 	// Since Read is destructive, we need to create a new reader that
 	// includes the bytes we just read plus the rest of the stream.
@@ -460,9 +716,9 @@ func isGzipCompressed(reader io.ReadCloser) (bool, io.ReadCloser, error) {
 	}
 
 	// Handle errors after reading the bytes, per Go's recommended pattern
-	if err != nil && err != io.EOF {
-		return false, newReader, err
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, newReader, err
 	}
 
-	return isGzip, newReader, nil
+	return buffer[:numbers], newReader, nil
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// customParserConfig is a parserConfig declared in the S3_PARSERS
+// configuration, keyed by the type it is registered as.
+type customParserConfig struct {
+	// value to use for the __aws_log_type label, and the name of the __aws_<log_type> labels
+	LogTypeLabel string `yaml:"log_type"`
+	// regex matching the object key, its named groups are exported as labels
+	FilenameRegex string `yaml:"filename_regex"`
+	// regex whose first group extracts the timestamp from each line
+	TimestampRegex string `yaml:"timestamp_regex"`
+	// Go time layout of the timestamp, for the string timestamp type
+	TimestampFormat string `yaml:"timestamp_format"`
+	// either string or unix
+	TimestampType string `yaml:"timestamp_type"`
+	// how many lines to skip at the beginning of the object
+	SkipHeaderCount int `yaml:"skip_header_count"`
+	// named group of filename_regex to use as the value of the __aws_<log_type>_owner label
+	OwnerLabelKey string `yaml:"owner_label_key"`
+}
+
+// namedParser is a parser and the type it is registered as.
+type namedParser struct {
+	name   string
+	config parserConfig
+}
+
+// parseCustomParsers parses the S3_PARSERS configuration. It is YAML, which
+// also accepts JSON, mapping the type of each parser to its configuration. The
+// parsers are returned in the order they are declared.
+func parseCustomParsers(raw string) ([]namedParser, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	var configs map[string]customParserConfig
+	decoder := yaml.NewDecoder(strings.NewReader(raw))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&configs); err != nil {
+		return nil, fmt.Errorf("failed to parse S3_PARSERS: %w", err)
+	}
+	// Maps lose the order of their keys, which the document keeps.
+	var document yaml.Node
+	if err := yaml.Unmarshal([]byte(raw), &document); err != nil {
+		return nil, fmt.Errorf("failed to parse S3_PARSERS: %w", err)
+	}
+	var names []string
+	if len(document.Content) == 1 {
+		content := document.Content[0].Content
+		for i := 0; i < len(content); i += 2 {
+			names = append(names, content[i].Value)
+		}
+	}
+
+	result := make([]namedParser, 0, len(names))
+	for _, name := range names {
+		if _, ok := parsers[name]; ok || name == CloudTrailDigestLogType {
+			return nil, fmt.Errorf("invalid S3 parser %s: type is already defined", name)
+		}
+		parser, err := configs[name].toParserConfig()
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3 parser %s: %w", name, err)
+		}
+		result = append(result, namedParser{name: name, config: parser})
+	}
+
+	return result, nil
+}
+
+func (c customParserConfig) toParserConfig() (parserConfig, error) {
+	if c.LogTypeLabel == "" || !model.LegacyValidation.IsValidLabelName("__aws_"+c.LogTypeLabel) {
+		return parserConfig{}, fmt.Errorf("invalid log_type %q", c.LogTypeLabel)
+	}
+
+	if c.FilenameRegex == "" {
+		return parserConfig{}, errors.New("filename_regex is required")
+	}
+	filenameRegex, err := regexp.Compile(c.FilenameRegex)
+	if err != nil {
+		return parserConfig{}, fmt.Errorf("invalid filename_regex: %w", err)
+	}
+	if c.OwnerLabelKey != "" && !slices.Contains(filenameRegex.SubexpNames(), c.OwnerLabelKey) {
+		return parserConfig{}, fmt.Errorf("owner_label_key %s is not a named group of filename_regex", c.OwnerLabelKey)
+	}
+
+	var timestampRegex *regexp.Regexp
+	if c.TimestampRegex != "" {
+		timestampRegex, err = regexp.Compile(c.TimestampRegex)
+		if err != nil {
+			return parserConfig{}, fmt.Errorf("invalid timestamp_regex: %w", err)
+		}
+		if timestampRegex.NumSubexp() == 0 {
+			return parserConfig{}, errors.New("timestamp_regex must have a group capturing the timestamp")
+		}
+	}
+
+	switch c.TimestampType {
+	case "":
+		if timestampRegex != nil {
+			return parserConfig{}, errors.New("timestamp_type is required with timestamp_regex")
+		}
+	case "string":
+		if c.TimestampFormat == "" {
+			return parserConfig{}, errors.New("timestamp_format is required with the string timestamp_type")
+		}
+	case "unix":
+	default:
+		return parserConfig{}, fmt.Errorf("invalid timestamp_type %q, expected string or unix", c.TimestampType)
+	}
+	if c.TimestampType != "" && timestampRegex == nil {
+		return parserConfig{}, errors.New("timestamp_regex is required with timestamp_type")
+	}
+
+	if c.SkipHeaderCount < 0 {
+		return parserConfig{}, fmt.Errorf("invalid skip_header_count %d", c.SkipHeaderCount)
+	}
+
+	return parserConfig{
+		logTypeLabel:    c.LogTypeLabel,
+		filenameRegex:   filenameRegex,
+		timestampRegex:  timestampRegex,
+		timestampFormat: c.TimestampFormat,
+		timestampType:   c.TimestampType,
+		skipHeaderCount: c.SkipHeaderCount,
+		ownerLabelKey:   c.OwnerLabelKey,
+	}, nil
+}
+
+// registerParsers adds the custom parsers to the built-in ones, ahead of them
+// in parserOrder.
+func registerParsers(custom []namedParser) {
+	names := make([]string, 0, len(custom))
+	for _, p := range custom {
+		parsers[p.name] = p.config
+		names = append(names, p.name)
+	}
+	parserOrder = slices.Concat(names, parserOrder)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/go-kit/log"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseCustomParsers(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr string
+	}{
+		{
+			name: "empty",
+			raw:  "",
+		},
+		{
+			name: "yaml",
+			raw: `
+myapp:
+  log_type: s3_myapp
+  filename_regex: 'myapp/(?P<account_id>\d+)/(?P<src>[\w-]+)/.+\.log'
+  timestamp_regex: '^(\S+)'
+  timestamp_format: '2006-01-02T15:04:05Z07:00'
+  timestamp_type: string
+  skip_header_count: 1
+  owner_label_key: account_id
+`,
+		},
+		{
+			name: "json",
+			raw:  `{"myapp": {"log_type": "s3_myapp", "filename_regex": "myapp/(?P<src>[\\w-]+)/", "timestamp_regex": "ts=(\\d+)", "timestamp_type": "unix"}}`,
+		},
+		{
+			name:    "unknown field",
+			raw:     `{"myapp": {"log_type": "s3_myapp", "filename_regex": "myapp/", "filename": "myapp"}}`,
+			wantErr: "failed to parse S3_PARSERS",
+		},
+		{
+			name:    "built-in type",
+			raw:     `{"vpcflowlogs": {"log_type": "s3_myapp", "filename_regex": "myapp/"}}`,
+			wantErr: "type is already defined",
+		},
+		{
+			name:    "invalid log type",
+			raw:     `{"myapp": {"log_type": "s3-myapp", "filename_regex": "myapp/"}}`,
+			wantErr: `invalid log_type "s3-myapp"`,
+		},
+		{
+			name:    "missing filename regex",
+			raw:     `{"myapp": {"log_type": "s3_myapp"}}`,
+			wantErr: "filename_regex is required",
+		},
+		{
+			name:    "unknown owner label key",
+			raw:     `{"myapp": {"log_type": "s3_myapp", "filename_regex": "myapp/(?P<src>[\\w-]+)/", "owner_label_key": "account_id"}}`,
+			wantErr: "owner_label_key account_id is not a named group of filename_regex",
+		},
+		{
+			name:    "timestamp regex without group",
+			raw:     `{"myapp": {"log_type": "s3_myapp", "filename_regex": "myapp/", "timestamp_regex": "\\d+", "timestamp_type": "unix"}}`,
+			wantErr: "timestamp_regex must have a group",
+		},
+		{
+			name:    "timestamp regex without type",
+			raw:     `{"myapp": {"log_type": "s3_myapp", "filename_regex": "myapp/", "timestamp_regex": "(\\d+)"}}`,
+			wantErr: "timestamp_type is required",
+		},
+		{
+			name:    "string timestamp without format",
+			raw:     `{"myapp": {"log_type": "s3_myapp", "filename_regex": "myapp/", "timestamp_regex": "(\\d+)", "timestamp_type": "string"}}`,
+			wantErr: "timestamp_format is required",
+		},
+		{
+			name:    "unknown timestamp type",
+			raw:     `{"myapp": {"log_type": "s3_myapp", "filename_regex": "myapp/", "timestamp_regex": "(\\d+)", "timestamp_type": "rfc3339"}}`,
+			wantErr: `invalid timestamp_type "rfc3339"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseCustomParsers(tt.raw)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+// registerTestParsers registers custom parsers for the duration of a test.
+func registerTestParsers(t *testing.T, custom []namedParser) {
+	order := parserOrder
+	t.Cleanup(func() {
+		for _, p := range custom {
+			delete(parsers, p.name)
+		}
+		parserOrder = order
+	})
+	registerParsers(custom)
+}
+
+func Test_customParser(t *testing.T) {
+	custom, err := parseCustomParsers(`
+myapp:
+  log_type: s3_myapp
+  filename_regex: 'myapp/(?P<account_id>\d+)/(?P<src>[\w-]+)/.+\.log'
+  timestamp_regex: '^(\S+)'
+  timestamp_format: '2006-01-02T15:04:05Z07:00'
+  timestamp_type: string
+  skip_header_count: 1
+  owner_label_key: account_id
+`)
+	require.NoError(t, err)
+	registerTestParsers(t, custom)
+
+	batchSize = 131072 // Set large enough we don't try and send to promtail
+	keepStream = false
+
+	labels, err := getLabels(events.S3EventRecord{
+		AWSRegion: "us-east-1",
+		S3: events.S3Entity{
+			Bucket: events.S3Bucket{Name: "app-logs"},
+			Object: events.S3Object{Key: "myapp/123456789012/checkout/2024-05-30.log"},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "myapp", labels["type"])
+	require.Equal(t, "checkout", labels["src"])
+	require.Equal(t, "123456789012", labels["account_id"])
+
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	b := &batch{
+		streams:   map[string]*logproto.Stream{},
+		processor: process,
+	}
+	obj := io.NopCloser(strings.NewReader(`timestamp message
+2024-05-30T07:00:01Z order placed
+2024-05-30T07:00:02Z order shipped
+`))
+	logger := log.NewNopLogger()
+	require.NoError(t, parseS3Log(context.Background(), b, labels, obj, &logger))
+
+	stream, ok := b.streams[`{__aws_log_type="s3_myapp", __aws_s3_myapp="checkout", __aws_s3_myapp_owner="123456789012"}`]
+	require.True(t, ok)
+	require.Len(t, stream.Entries, 2)
+	require.Equal(t, "2024-05-30T07:00:01Z order placed", stream.Entries[0].Line)
+	require.Equal(t, time.Date(2024, time.May, 30, 7, 0, 1, 0, time.UTC), stream.Entries[0].Timestamp)
+	require.Equal(t, time.Date(2024, time.May, 30, 7, 0, 2, 0, time.UTC), stream.Entries[1].Timestamp)
+}
+
+func Test_getLabels_parserOrder(t *testing.T) {
+	record := func(key string) events.S3EventRecord {
+		return events.S3EventRecord{S3: events.S3Entity{Object: events.S3Object{Key: key}}}
+	}
+
+	for _, order := range [][]string{{"specific", "catchall"}, {"catchall", "specific"}} {
+		t.Run(strings.Join(order, "_then_"), func(t *testing.T) {
+			configs := map[string]string{
+				"specific": `{log_type: s3_specific, filename_regex: 'apps/(?P<src>checkout)/.+\.log'}`,
+				"catchall": `{log_type: s3_catchall, filename_regex: 'apps/(?P<app>[\w-]+)/'}`,
+			}
+			custom, err := parseCustomParsers(order[0] + ": " + configs[order[0]] + "\n" + order[1] + ": " + configs[order[1]])
+			require.NoError(t, err)
+			require.Equal(t, order[0], custom[0].name)
+			registerTestParsers(t, custom)
+
+			// Every run picks the same parser, the first one declared.
+			for range 20 {
+				labels, err := getLabels(record("apps/checkout/2024-05-30.log"))
+				require.NoError(t, err)
+				require.Equal(t, order[0], labels["type"])
+				// Only the named groups of the chosen parser are exported.
+				if order[0] == "specific" {
+					require.Equal(t, "checkout", labels["src"])
+					require.NotContains(t, labels, "app")
+				} else {
+					require.Equal(t, "checkout", labels["app"])
+					require.NotContains(t, labels, "src")
+				}
+			}
+
+			labels, err := getLabels(record("apps/cart/2024-05-30.log"))
+			require.NoError(t, err)
+			require.Equal(t, "catchall", labels["type"])
+		})
+	}
+
+	// Custom parsers are tried before the built-in ones.
+	custom, err := parseCustomParsers(`{albcopy: {log_type: s3_albcopy, filename_regex: 'elasticloadbalancing'}}`)
+	require.NoError(t, err)
+	registerTestParsers(t, custom)
+	labels, err := getLabels(record("my-bucket/AWSLogs/123456789012/elasticloadbalancing/us-east-1/2022/01/24/123456789012_elasticloadbalancing_us-east-1_app.my-loadbalancer.b13ea9d19f16d015_20220124T0000Z_0.0.0.0_2et2e1mx.log.gz"))
+	require.NoError(t, err)
+	require.Equal(t, "albcopy", labels["type"])
+}
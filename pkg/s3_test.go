@@ -3,15 +3,26 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/go-kit/log"
+	"github.com/grafana/loki/pkg/push"
 	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/require"
 )
 
@@ -674,7 +685,12 @@ func Test_parseS3Log(t *testing.T) {
 			},
 			expectedLen:    1,
 			expectedStream: `{__aws_log_type="s3_vpc_flow", __aws_s3_vpc_flow="source", __aws_s3_vpc_flow_owner="123456789"}`,
-			wantErr:        false,
+			expectedTimestamps: []time.Time{
+				time.Date(2022, time.November, 30, 21, 11, 41, 0, time.UTC),
+				time.Date(2022, time.November, 30, 21, 11, 41, 0, time.UTC),
+				time.Date(2022, time.November, 30, 21, 11, 55, 0, time.UTC),
+			},
+			wantErr: false,
 		},
 		{
 			name: "albaccesslogs",
@@ -859,6 +875,72 @@ func Test_parseS3Log(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "s3_access_zstd",
+			args: args{
+				batchSize: 131072, // Set large enough we don't try and send to promtail
+				filename:  "../testdata/s3accesslog.log.zst",
+				b: &batch{
+					streams:   map[string]*logproto.Stream{},
+					processor: process,
+				},
+				labels: map[string]string{
+					"account_id": "123456789012",
+					"src":        "amzn-s3-demo-bucket1",
+					"type":       S3AccessLogType,
+				},
+			},
+			expectedLen:    1,
+			expectedStream: `{__aws_log_type="s3_access", __aws_s3_access="amzn-s3-demo-bucket1", __aws_s3_access_owner="123456789012"}`,
+			expectedTimestamps: []time.Time{
+				time.Date(2019, time.February, 6, 0, 0, 38, 0, time.UTC),
+			},
+			wantErr: false,
+		},
+		{
+			name: "s3_access_bzip2",
+			args: args{
+				batchSize: 131072, // Set large enough we don't try and send to promtail
+				filename:  "../testdata/s3accesslog.log.bz2",
+				b: &batch{
+					streams:   map[string]*logproto.Stream{},
+					processor: process,
+				},
+				labels: map[string]string{
+					"account_id": "123456789012",
+					"src":        "amzn-s3-demo-bucket1",
+					"type":       S3AccessLogType,
+				},
+			},
+			expectedLen:    1,
+			expectedStream: `{__aws_log_type="s3_access", __aws_s3_access="amzn-s3-demo-bucket1", __aws_s3_access_owner="123456789012"}`,
+			expectedTimestamps: []time.Time{
+				time.Date(2019, time.February, 6, 0, 0, 38, 0, time.UTC),
+			},
+			wantErr: false,
+		},
+		{
+			name: "s3_access_snappy",
+			args: args{
+				batchSize: 131072, // Set large enough we don't try and send to promtail
+				filename:  "../testdata/s3accesslog.log.sz",
+				b: &batch{
+					streams:   map[string]*logproto.Stream{},
+					processor: process,
+				},
+				labels: map[string]string{
+					"account_id": "123456789012",
+					"src":        "amzn-s3-demo-bucket1",
+					"type":       S3AccessLogType,
+				},
+			},
+			expectedLen:    1,
+			expectedStream: `{__aws_log_type="s3_access", __aws_s3_access="amzn-s3-demo-bucket1", __aws_s3_access_owner="123456789012"}`,
+			expectedTimestamps: []time.Time{
+				time.Date(2019, time.February, 6, 0, 0, 38, 0, time.UTC),
+			},
+			wantErr: false,
+		},
 		{
 			name: "missing_parser",
 			args: args{
@@ -938,6 +1020,41 @@ func Test_parseS3Log(t *testing.T) {
 	}
 }
 
+func Test_parseS3Log_flowLogCustomFormat(t *testing.T) {
+	batchSize = 131072 // Set large enough we don't try and send to promtail
+	structuredMetadataLabels = []model.LabelName{"__aws_s3_vpc_flow_action", "__aws_s3_vpc_flow_srcaddr", "__aws_s3_vpc_flow_pkt_dstaddr"}
+	defer func() { structuredMetadataLabels = nil }()
+
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	b := &batch{
+		streams:   map[string]*logproto.Stream{},
+		processor: process,
+	}
+	obj := io.NopCloser(strings.NewReader(`srcaddr pkt-dstaddr start end action log-status
+10.0.0.1 10.0.0.2 1669842701 1669842702 ACCEPT OK
+- - 1669842715 1669842716 - NODATA
+`))
+	logger := log.NewNopLogger()
+	labels := map[string]string{
+		"type":       FlowLogType,
+		"src":        "source",
+		"account_id": "123456789",
+	}
+	require.NoError(t, parseS3Log(context.Background(), b, labels, obj, &logger))
+
+	stream, ok := b.streams[`{__aws_log_type="s3_vpc_flow", __aws_s3_vpc_flow="source", __aws_s3_vpc_flow_owner="123456789"}`]
+	require.True(t, ok)
+	require.Len(t, stream.Entries, 2)
+	require.Equal(t, time.Date(2022, time.November, 30, 21, 11, 41, 0, time.UTC), stream.Entries[0].Timestamp)
+	require.Equal(t, push.LabelsAdapter{
+		{Name: "aws_s3_vpc_flow_action", Value: "ACCEPT"},
+		{Name: "aws_s3_vpc_flow_srcaddr", Value: "10.0.0.1"},
+		{Name: "aws_s3_vpc_flow_pkt_dstaddr", Value: "10.0.0.2"},
+	}, stream.Entries[0].StructuredMetadata)
+	require.Equal(t, time.Date(2022, time.November, 30, 21, 11, 55, 0, time.UTC), stream.Entries[1].Timestamp)
+	require.Empty(t, stream.Entries[1].StructuredMetadata)
+}
+
 func TestStringToRawEvent(t *testing.T) {
 	tc := &events.SQSEvent{
 		Records: []events.SQSMessage{
@@ -1034,15 +1151,139 @@ func TestProcessSQSEvent(t *testing.T) {
 	ctx := context.Background()
 	handlerCalled := false
 
-	err := processSQSEvent(ctx, evt, func(_ context.Context, ev map[string]interface{}) error {
+	logger := log.NewNopLogger()
+	resp, err := processSQSEvent(ctx, evt, func(_ context.Context, ev map[string]interface{}) error {
 		handlerCalled = true
 		require.Equal(t, map[string]interface{}{"pass": "pass"}, ev)
 		return nil
-	})
+	}, &logger)
 	require.Nil(t, err)
+	require.Empty(t, resp.BatchItemFailures)
 	require.True(t, handlerCalled)
 }
 
+func TestProcessSQSEvent_BatchItemFailures(t *testing.T) {
+	evt := &events.SQSEvent{
+		Records: []events.SQSMessage{
+			{MessageId: "ok-1", Body: `{"pass": "pass"}`},
+			{MessageId: "fail", Body: `{"fail": "fail"}`},
+			{MessageId: "invalid", Body: `not json`},
+			{MessageId: "ok-2", Body: `{"pass": "pass"}`},
+		},
+	}
+	process := func(_ context.Context, ev map[string]interface{}) error {
+		if _, ok := ev["fail"]; ok {
+			return errors.New("failed")
+		}
+		return nil
+	}
+	logger := log.NewNopLogger()
+
+	t.Run("disabled", func(t *testing.T) {
+		reportBatchItemFailures = false
+		_, err := processSQSEvent(context.Background(), evt, process, &logger)
+		require.Error(t, err)
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		reportBatchItemFailures = true
+		defer func() { reportBatchItemFailures = false }()
+
+		resp, err := processSQSEvent(context.Background(), evt, process, &logger)
+		require.NoError(t, err)
+		require.Equal(t, []events.SQSBatchItemFailure{
+			{ItemIdentifier: "fail"},
+			{ItemIdentifier: "invalid"},
+		}, resp.BatchItemFailures)
+	})
+
+	t.Run("messages are processed one at a time with concurrency", func(t *testing.T) {
+		s3Concurrency = 3
+		defer func() { s3Concurrency = 1 }()
+
+		var running, maxRunning atomic.Int32
+		_, err := processSQSEvent(context.Background(), evt, func(_ context.Context, _ map[string]interface{}) error {
+			n := running.Add(1)
+			defer running.Add(-1)
+			if n > maxRunning.Load() {
+				maxRunning.Store(n)
+			}
+			time.Sleep(5 * time.Millisecond)
+			return nil
+		}, &logger)
+		require.Error(t, err, "the invalid message still fails")
+		require.Equal(t, int32(1), maxRunning.Load())
+	})
+}
+
+func TestProcessS3Event_concurrency(t *testing.T) {
+	batchSize = 131072
+	s3Concurrency = 2
+	defer func() { s3Concurrency = 1 }()
+
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+		time.Sleep(20 * time.Millisecond)
+
+		if strings.Contains(r.URL.Path, "missing") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "line of %s\n", r.URL.Path)
+	}))
+	t.Cleanup(server.Close)
+
+	s3ClientsMu.Lock()
+	s3Clients = map[string]*s3.Client{"us-east-1": s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})}
+	s3ClientsMu.Unlock()
+
+	key := func(name string) string {
+		return "AWSLogs/123456789012/elasticloadbalancing/us-east-1/2024/01/01/123456789012_elasticloadbalancing_us-east-1_app." + name + ".b13ea9d19f16d015_20240101T0000Z_0.0.0.0_2et2e1mx.log"
+	}
+	record := func(name string) events.S3EventRecord {
+		return events.S3EventRecord{
+			AWSRegion: "us-east-1",
+			S3: events.S3Entity{
+				Bucket: events.S3Bucket{Name: "bucket"},
+				Object: events.S3Object{Key: key(name)},
+			},
+		}
+	}
+	ev := &events.S3Event{Records: []events.S3EventRecord{record("lb-1"), record("missing"), record("lb-2"), record("lb-3")}}
+
+	client := &concurrentClient{}
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	logger := log.NewNopLogger()
+	err := processS3Event(context.Background(), ev, client, process, &logger)
+
+	var objectErr *s3ObjectError
+	require.ErrorAs(t, err, &objectErr)
+	require.Equal(t, key("missing"), objectErr.key)
+	require.ErrorContains(t, err, "404")
+	require.Equal(t, 2, maxInFlight)
+
+	var lines []string
+	for _, streamLines := range client.lines {
+		lines = append(lines, streamLines...)
+	}
+	require.Len(t, lines, 3, "the other objects are sent")
+}
+
 func TestGetUnixSecNsec(t *testing.T) {
 	type args struct {
 		s string
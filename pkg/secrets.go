@@ -3,8 +3,12 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"net/url"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/aws/smithy-go/ptr"
@@ -48,3 +52,36 @@ func (c *secretClients) FetchFromAWSSSMParameterStore(ctx context.Context, param
 
 	return *out.Parameter.Value, nil
 }
+
+func (c *secretClients) FetchFromS3(ctx context.Context, uri string) (string, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("error parsing S3 URI %s: %w", uri, err)
+	}
+	bucket, key := parsed.Host, strings.TrimPrefix(parsed.Path, "/")
+	if bucket == "" || key == "" {
+		return "", fmt.Errorf("invalid S3 URI %s, expected s3://bucket/key", uri)
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error loading aws config: %w", err)
+	}
+
+	client := s3.NewFromConfig(cfg)
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error fetching S3 object %s: %w", uri, err)
+	}
+	defer out.Body.Close()
+
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading S3 object %s: %w", uri, err)
+	}
+
+	return string(data), nil
+}
@@ -13,6 +13,7 @@ var (
 type testSecretsClient struct {
 	CallsFetchFromAWSSecretsManager    int
 	CallsFetchFromAWSSSMParameterStore int
+	CallsFetchFromS3                   int
 
 	ExpectedArn string
 	ReturnValue string
@@ -37,3 +38,13 @@ func (c *testSecretsClient) FetchFromAWSSSMParameterStore(_ context.Context, par
 
 	return c.ReturnValue, nil
 }
+
+func (c *testSecretsClient) FetchFromS3(_ context.Context, uri string) (string, error) {
+	c.CallsFetchFromS3++
+
+	if c.ExpectedArn != "" && uri != c.ExpectedArn {
+		return "", errInvalidArn
+	}
+
+	return c.ReturnValue, nil
+}
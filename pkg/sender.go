@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// batchSender sends the flushes of a batch on up to MAX_IN_FLIGHT goroutines,
+// so that the batch keeps being filled while they are sent. Flushes sharing a
+// stream are sent one after the other, so the entries of each stream reach
+// Loki in order.
+type batchSender struct {
+	client Client
+	// holds a token for each flush being sent
+	slots chan struct{}
+	wg    sync.WaitGroup
+
+	mu sync.Mutex
+	// flushes in the order they were queued, until they and the ones before
+	// them are completed
+	queue []*pendingFlush
+	// done channel of the last flush queued with each stream
+	streams map[string]chan struct{}
+	// number of lines of the completed flushes
+	sent int
+	// first error of the flushes
+	err error
+	// whether a flush failed among the ones whose progress was considered,
+	// after which no progress is saved
+	progressStopped bool
+}
+
+type pendingFlush struct {
+	b       *batch
+	entries int
+	// saves the progress of the entries added before the flush, nil if there
+	// is none to save
+	saveProgress func(ctx context.Context) error
+	done         chan struct{}
+	completed    bool
+	err          error
+}
+
+func newBatchSender(client Client, maxInFlight int) *batchSender {
+	return &batchSender{
+		client:  client,
+		slots:   make(chan struct{}, maxInFlight),
+		streams: map[string]chan struct{}{},
+	}
+}
+
+// send queues a flush, waiting for a free slot if MAX_IN_FLIGHT flushes are
+// already being sent. It returns the error of a previous flush, so that the
+// caller stops adding entries once one failed.
+func (s *batchSender) send(ctx context.Context, b *batch, saveProgress func(ctx context.Context) error) error {
+	if err := s.error(); err != nil {
+		return err
+	}
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	f := &pendingFlush{
+		b:            b,
+		entries:      b.entriesCount(),
+		saveProgress: saveProgress,
+		done:         make(chan struct{}),
+	}
+	var previous []chan struct{}
+	s.mu.Lock()
+	for key := range b.streams {
+		if done, ok := s.streams[key]; ok {
+			previous = append(previous, done)
+		}
+		s.streams[key] = f.done
+	}
+	s.queue = append(s.queue, f)
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for _, done := range previous {
+			<-done
+		}
+		err := s.client.sendToPromtail(ctx, f.b)
+		<-s.slots
+		s.complete(ctx, f, err)
+	}()
+	return nil
+}
+
+// complete records the outcome of a flush. The progress of flushes is saved in
+// the order they were queued, once every flush before them was sent, and no
+// longer after one failed.
+func (s *batchSender) complete(ctx context.Context, f *pendingFlush, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f.completed = true
+	f.err = err
+	close(f.done)
+	for key := range f.b.streams {
+		if s.streams[key] == f.done {
+			delete(s.streams, key)
+		}
+	}
+	if err != nil && s.err == nil {
+		s.err = err
+	}
+
+	for len(s.queue) > 0 && s.queue[0].completed {
+		head := s.queue[0]
+		s.queue = s.queue[1:]
+		if head.err != nil {
+			s.progressStopped = true
+			continue
+		}
+		s.sent += head.entries
+		if !s.progressStopped && head.saveProgress != nil {
+			if err := head.saveProgress(ctx); err != nil {
+				s.progressStopped = true
+				if s.err == nil {
+					s.err = err
+				}
+			}
+		}
+	}
+}
+
+func (s *batchSender) error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// wait blocks until every queued flush is completed. It returns the number of
+// lines sent so far, and the first error of the flushes.
+func (s *batchSender) wait() (int, error) {
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sent, s.err
+}
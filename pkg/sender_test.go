@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+// concurrentClient records the lines of each stream in the order they were
+// sent, and how many flushes were sent at once.
+type concurrentClient struct {
+	mu          sync.Mutex
+	lines       map[string][]string
+	inFlight    int
+	maxInFlight int
+	flushes     int
+	// delay of each flush, by flush number, or of every flush without it
+	delays map[int]time.Duration
+	delay  time.Duration
+	// stream whose flushes fail
+	failingStream string
+}
+
+func (c *concurrentClient) sendToPromtail(_ context.Context, b *batch) error {
+	c.mu.Lock()
+	c.flushes++
+	n := c.flushes
+	c.inFlight++
+	c.maxInFlight = max(c.maxInFlight, c.inFlight)
+	delay, ok := c.delays[n]
+	if !ok {
+		delay = c.delay
+	}
+	c.mu.Unlock()
+
+	time.Sleep(delay)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight--
+	if _, ok := b.streams[c.failingStream]; ok {
+		return fmt.Errorf("flush of %s failed", c.failingStream)
+	}
+	if c.lines == nil {
+		c.lines = map[string][]string{}
+	}
+	for _, stream := range b.streams {
+		for _, e := range stream.Entries {
+			c.lines[stream.Labels] = append(c.lines[stream.Labels], e.Line)
+		}
+	}
+	return nil
+}
+
+func withMaxInFlight(t *testing.T, n int) {
+	t.Helper()
+	maxInFlight = n
+	batchSize = 1 // flush every line
+	t.Cleanup(func() {
+		maxInFlight = 1
+		batchSize = 131072
+	})
+}
+
+func TestBatch_concurrentFlushes(t *testing.T) {
+	withMaxInFlight(t, 3)
+
+	client := &concurrentClient{delay: 10 * time.Millisecond}
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	b, err := newBatch(context.Background(), client, process)
+	require.NoError(t, err)
+
+	want := map[string][]string{}
+	for i := range 20 {
+		app := fmt.Sprintf("app-%d", i%4)
+		line := fmt.Sprintf("line %d", i)
+		require.NoError(t, b.add(context.Background(), entry{labels: model.LabelSet{"app": model.LabelValue(app)}, entry: logproto.Entry{Line: line, Timestamp: time.Now()}}))
+		labels := fmt.Sprintf("{app=%q}", app)
+		want[labels] = append(want[labels], line)
+	}
+	require.NoError(t, b.flushBatch(context.Background()))
+
+	require.Equal(t, want, client.lines, "the lines of each stream are sent in order")
+	require.Equal(t, 20, b.sent)
+	require.Equal(t, 3, client.maxInFlight)
+}
+
+func TestBatch_concurrentFlushesOfAStream(t *testing.T) {
+	withMaxInFlight(t, 3)
+
+	// The first flush is the slowest, the following ones wait for it.
+	client := &concurrentClient{delays: map[int]time.Duration{1: 50 * time.Millisecond}}
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	b, err := newBatch(context.Background(), client, process)
+	require.NoError(t, err)
+
+	for i := range 5 {
+		require.NoError(t, b.add(context.Background(), entry{labels: model.LabelSet{"app": "a"}, entry: logproto.Entry{Line: fmt.Sprintf("line %d", i), Timestamp: time.Now()}}))
+	}
+	require.NoError(t, b.flushBatch(context.Background()))
+
+	require.Equal(t, []string{"line 0", "line 1", "line 2", "line 3", "line 4"}, client.lines[`{app="a"}`])
+	require.Equal(t, 1, client.maxInFlight)
+}
+
+func TestBatch_concurrentFlushErrors(t *testing.T) {
+	withMaxInFlight(t, 2)
+
+	client := &concurrentClient{failingStream: `{app="app-1"}`}
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	b, err := newBatch(context.Background(), client, process)
+	require.NoError(t, err)
+
+	var saved []int
+	var progress int
+	b.saveProgress = func() func(ctx context.Context) error {
+		progress++
+		n := progress
+		return func(context.Context) error {
+			saved = append(saved, n)
+			return nil
+		}
+	}
+
+	for i := 0; ; i++ {
+		err = b.add(context.Background(), entry{labels: model.LabelSet{"app": model.LabelValue(fmt.Sprintf("app-%d", i))}, entry: logproto.Entry{Line: "line", Timestamp: time.Now()}})
+		if err != nil {
+			break
+		}
+		require.Less(t, i, 100, "adding entries must stop after a flush failed")
+	}
+	require.ErrorContains(t, err, `flush of {app="app-1"} failed`)
+
+	err = b.flushBatch(context.Background())
+	require.ErrorContains(t, err, `flush of {app="app-1"} failed`)
+	require.Equal(t, []int{1}, saved, "no progress is saved past the failed flush")
+	require.Equal(t, client.flushes-1, b.sent)
+}
+
+func TestBatchSender_savesProgressInOrder(t *testing.T) {
+	client := &concurrentClient{delays: map[int]time.Duration{1: 50 * time.Millisecond}}
+	s := newBatchSender(client, 2)
+
+	var mu sync.Mutex
+	var saved []string
+	save := func(name string) func(ctx context.Context) error {
+		return func(context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			saved = append(saved, name)
+			return nil
+		}
+	}
+
+	for _, name := range []string{"first", "second"} {
+		b := &batch{streams: map[string]*logproto.Stream{
+			name: {Labels: fmt.Sprintf("{app=%q}", name), Entries: []logproto.Entry{{Line: name}}},
+		}}
+		require.NoError(t, s.send(context.Background(), b, save(name)))
+	}
+	sent, err := s.wait()
+	require.NoError(t, err)
+	require.Equal(t, 2, sent)
+	require.Equal(t, []string{"first", "second"}, saved)
+}
+
+func TestBatchSender_contextDone(t *testing.T) {
+	client := &concurrentClient{delay: 100 * time.Millisecond}
+	s := newBatchSender(client, 1)
+
+	b := &batch{streams: map[string]*logproto.Stream{"a": {Labels: `{app="a"}`, Entries: []logproto.Entry{{Line: "a"}}}}}
+	require.NoError(t, s.send(context.Background(), b, nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := s.send(ctx, b, nil)
+	require.True(t, errors.Is(err, context.Canceled))
+	_, err = s.wait()
+	require.NoError(t, err)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// sigv4Config is the sigv4 field of a destination of the DESTINATIONS
+// environment variable.
+type sigv4Config struct {
+	// signing name of the service, like execute-api for API Gateway
+	Service string `json:"service"`
+	// region of the endpoint, the region of the function if empty
+	Region string `json:"region,omitempty"`
+}
+
+// sigv4Signer signs the push requests to a destination with AWS Signature
+// Version 4, using the credentials of the Lambda execution role.
+type sigv4Signer struct {
+	service     string
+	region      string
+	credentials aws.CredentialsProvider
+	signer      *v4.Signer
+}
+
+func newSigV4Signer(ctx context.Context, service, region string) (*sigv4Signer, error) {
+	if service == "" {
+		return nil, errors.New("the service to sign requests for is required")
+	}
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error loading aws config: %w", err)
+	}
+	if region == "" {
+		region = cfg.Region
+	}
+	if region == "" {
+		return nil, errors.New("the region to sign requests for is required")
+	}
+	return &sigv4Signer{
+		service: service,
+		region:  region,
+		// The default config caches the credentials until they expire.
+		credentials: cfg.Credentials,
+		signer:      v4.NewSigner(),
+	}, nil
+}
+
+// sign adds the signature of a request with the given body to its headers. It
+// must be called once every other header is set.
+func (s *sigv4Signer) sign(ctx context.Context, req *http.Request, body []byte) error {
+	creds, err := s.credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("error retrieving aws credentials: %w", err)
+	}
+	hash := sha256.Sum256(body)
+	return s.signer.SignHTTP(ctx, creds, req, hex.EncodeToString(hash[:]), s.service, s.region, time.Now())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/backoff"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/stretchr/testify/require"
+)
+
+var sigv4AuthorizationRegex = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=AKID/\d{8}/eu-west-1/execute-api/aws4_request, SignedHeaders=([\w;-]+), Signature=[0-9a-f]{64}$`)
+
+func Test_promtailClient_sigv4(t *testing.T) {
+	var headers http.Header
+	loki := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer loki.Close()
+
+	writeAddress, err := url.Parse(loki.URL)
+	require.NoError(t, err)
+	logger := log.NewNopLogger()
+	client := NewPromtailClient(&promtailClientConfig{
+		backoff: &backoff.Config{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 1},
+		http:    &httpClientConfig{timeout: time.Second},
+		destinations: []*destination{{
+			name:         "default",
+			writeAddress: writeAddress,
+			tenantID:     "team",
+			sigv4: &sigv4Signer{
+				service: "execute-api",
+				region:  "eu-west-1",
+				credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+					return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "SECRET", SessionToken: "TOKEN"}, nil
+				}),
+				signer: v4.NewSigner(),
+			},
+		}},
+	}, &logger)
+
+	b := &batch{streams: map[string]*logproto.Stream{
+		`{app="a"}`: {Labels: `{app="a"}`, Entries: []logproto.Entry{{Timestamp: time.Now(), Line: "hello"}}},
+	}}
+	require.NoError(t, client.sendToPromtail(context.Background(), b))
+
+	match := sigv4AuthorizationRegex.FindStringSubmatch(headers.Get("Authorization"))
+	require.NotNil(t, match, headers.Get("Authorization"))
+	// The tenant and content headers are signed along with the host and date.
+	require.Equal(t, "content-length;content-type;host;x-amz-date;x-amz-security-token;x-scope-orgid", match[1])
+	require.Equal(t, "TOKEN", headers.Get("X-Amz-Security-Token"))
+	require.NotEmpty(t, headers.Get("X-Amz-Date"))
+}
+
+func Test_parseDestinations_sigv4(t *testing.T) {
+	destinations, err := parseDestinations(context.Background(), &testSecretsClient{}, `[{"write_address": "https://loki.example.com", "sigv4": {"service": "execute-api", "region": "eu-west-1"}}]`)
+	require.NoError(t, err)
+	require.Equal(t, "execute-api", destinations[0].sigv4.service)
+	require.Equal(t, "eu-west-1", destinations[0].sigv4.region)
+
+	_, err = parseDestinations(context.Background(), &testSecretsClient{}, `[{"write_address": "https://loki.example.com", "sigv4": {"region": "eu-west-1"}}]`)
+	require.ErrorContains(t, err, "the service to sign requests for is required")
+
+	_, err = parseDestinations(context.Background(), &testSecretsClient{}, `[{"write_address": "https://loki.example.com", "bearer_token": "token", "sigv4": {"service": "execute-api"}}]`)
+	require.ErrorContains(t, err, "sigv4 is not allowed with username or bearer_token")
+}
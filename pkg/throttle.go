@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// interval between requests once Loki first rate limits a tenant
+	minThrottleInterval = 100 * time.Millisecond
+	// also the longest Retry-After honoured, as a throttle outlives the
+	// invocation that was asked to wait
+	maxThrottleInterval = 30 * time.Second
+)
+
+// throttle paces the requests to a tenant of a destination once Loki starts
+// rate limiting them. The interval between requests doubles on every 429 or
+// 503, and shrinks by a tenth on every success until requests are no longer
+// paced. It is kept by the client, so it lasts for as long as the container.
+type throttle struct {
+	mu sync.Mutex
+	// minimum time between the start of two requests, zero when not throttled
+	interval time.Duration
+	// earliest time the next request can start
+	next time.Time
+}
+
+// wait blocks until the next request can be sent.
+func (t *throttle) wait(ctx context.Context) error {
+	t.mu.Lock()
+	now := time.Now()
+	start := now
+	if t.next.After(now) {
+		start = t.next
+	}
+	t.next = start.Add(t.interval)
+	t.mu.Unlock()
+
+	return sleep(ctx, start.Sub(now))
+}
+
+// throttled slows down the requests after Loki rate limited one. No request
+// starts before retryAfter, if it is set, capped to maxThrottleInterval.
+func (t *throttle) throttled(retryAfter time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.interval = min(max(2*t.interval, minThrottleInterval), maxThrottleInterval)
+	retryAfter = min(retryAfter, maxThrottleInterval)
+	if retryAfter > 0 {
+		if until := time.Now().Add(retryAfter); until.After(t.next) {
+			t.next = until
+		}
+	}
+}
+
+func (t *throttle) succeeded() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.interval -= t.interval / 10
+	if t.interval < minThrottleInterval {
+		t.interval = 0
+	}
+}
+
+// throttle returns the throttle of a tenant of a destination.
+func (c *promtailClient) throttle(d *destination, tenantID string) *throttle {
+	c.throttlesMu.Lock()
+	defer c.throttlesMu.Unlock()
+
+	key := d.name + "/" + tenantID
+	t, ok := c.throttles[key]
+	if !ok {
+		t = &throttle{}
+		if c.throttles == nil {
+			c.throttles = map[string]*throttle{}
+		}
+		c.throttles[key] = t
+	}
+	return t
+}
+
+// isRateLimited reports whether the status asks to slow down.
+func isRateLimited(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// parseRetryAfter parses a Retry-After header, either a number of seconds or
+// an HTTP date, capped to maxThrottleInterval. It returns zero if the header
+// isn't set or is invalid.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return min(max(time.Duration(seconds)*time.Second, 0), maxThrottleInterval)
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return min(max(time.Until(date), 0), maxThrottleInterval)
+	}
+	return 0
+}
+
+// retryAfter returns the Retry-After of the response the error is about.
+func retryAfter(err error) time.Duration {
+	var respErr *responseError
+	if errors.As(err, &respErr) {
+		return respErr.retryAfter
+	}
+	return 0
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/backoff"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseRetryAfter(t *testing.T) {
+	for header, want := range map[string]time.Duration{
+		"":        0,
+		"3":       3 * time.Second,
+		"-1":      0,
+		"invalid": 0,
+		// Retry-After is capped, a throttle lasts across invocations.
+		"86400": maxThrottleInterval,
+		time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat): 0,
+		time.Now().Add(time.Hour).UTC().Format(http.TimeFormat):  maxThrottleInterval,
+	} {
+		require.Equal(t, want, parseRetryAfter(header), header)
+	}
+
+	date := time.Now().Add(20 * time.Second).UTC().Format(http.TimeFormat)
+	require.InDelta(t, 20*time.Second, parseRetryAfter(date), float64(2*time.Second))
+}
+
+func TestThrottle(t *testing.T) {
+	th := &throttle{}
+	th.throttled(0)
+	require.Equal(t, minThrottleInterval, th.interval)
+	th.throttled(0)
+	require.Equal(t, 2*minThrottleInterval, th.interval)
+
+	th.succeeded()
+	require.Equal(t, 180*time.Millisecond, th.interval)
+	for range 10 {
+		th.succeeded()
+	}
+	require.Zero(t, th.interval, "requests are no longer paced")
+
+	th.throttled(time.Hour)
+	require.WithinDuration(t, time.Now().Add(maxThrottleInterval), th.next, time.Second, "retryAfter is capped")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, th.wait(ctx), context.DeadlineExceeded)
+}
+
+func Test_promtailClient_retryAfter(t *testing.T) {
+	batchSize = 131072
+
+	var requests []time.Time
+	loki := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests = append(requests, time.Now())
+		if len(requests) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(loki.Close)
+
+	destinations, err := parseDestinations(context.Background(), &testSecretsClient{}, `[{"write_address": "`+loki.URL+`"}]`)
+	require.NoError(t, err)
+	logger := log.NewNopLogger()
+	client := NewPromtailClient(&promtailClientConfig{
+		backoff:      &backoff.Config{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 3},
+		http:         &httpClientConfig{timeout: time.Second},
+		destinations: destinations,
+	}, &logger)
+
+	process, _ := ParsePipelineConfigs("", nil, nil)
+	for range 2 {
+		b, err := newBatch(context.Background(), nil, process,
+			entry{labels: model.LabelSet{"app": "a"}, entry: logproto.Entry{Line: "line", Timestamp: time.Now()}},
+		)
+		require.NoError(t, err)
+		require.NoError(t, client.sendToPromtail(context.Background(), b))
+	}
+
+	require.Len(t, requests, 3)
+	require.GreaterOrEqual(t, requests[1].Sub(requests[0]), time.Second, "the retry waits for Retry-After")
+	// The tenant is still throttled for the next batch.
+	require.GreaterOrEqual(t, requests[2].Sub(requests[1]), minThrottleInterval*9/10)
+}